@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wallix/awless-scheduler/model"
+)
+
+const schedulerCaller = "scheduler"
+
+// nil when audit is disabled
+var auditor *auditLog
+
+type callerKey struct{}
+
+// auditLog appends entries to a JSON lines file. Each entry holds the hash of
+// the previous one, so that any change to a recorded entry breaks the chain
+type auditLog struct {
+	mux      sync.Mutex
+	path     string
+	seq      int64
+	lastHash string
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	entries, err := readAuditEntries(path)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLog{path: path}
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		a.seq, a.lastHash = last.Seq, last.Hash
+	}
+	return a, nil
+}
+
+func (a *auditLog) record(e *model.AuditEntry) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	e.Seq, e.PrevHash = a.seq+1, a.lastHash
+	hash, err := auditHash(e)
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+
+	a.seq, a.lastHash = e.Seq, e.Hash
+	return nil
+}
+
+func (a *auditLog) entries() ([]*model.AuditEntry, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	return readAuditEntries(a.path)
+}
+
+// auditHash is the hex SHA-256 of the entry without its hash, which includes the previous hash
+func auditHash(e *model.AuditEntry) (string, error) {
+	unhashed := *e
+	unhashed.Hash = ""
+	b, err := json.Marshal(unhashed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func readAuditEntries(path string) ([]*model.AuditEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*model.AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		e := new(model.AuditEntry)
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return entries, fmt.Errorf("invalid audit entry at line %d: %s", line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// verifyAuditLog checks the hash chain of the audit log and returns the number of verified entries
+func verifyAuditLog(path string) (int, error) {
+	entries, err := readAuditEntries(path)
+	if err != nil {
+		return len(entries), err
+	}
+
+	var prevHash string
+	for i, e := range entries {
+		if e.Seq != int64(i+1) {
+			return i, fmt.Errorf("audit entry %d: unexpected sequence number %d", i+1, e.Seq)
+		}
+		if e.PrevHash != prevHash {
+			return i, fmt.Errorf("audit entry %d: previous hash does not match entry %d", e.Seq, e.Seq-1)
+		}
+		hash, err := auditHash(e)
+		if err != nil {
+			return i, err
+		}
+		if hash != e.Hash {
+			return i, fmt.Errorf("audit entry %d: hash does not match its content", e.Seq)
+		}
+		prevHash = e.Hash
+	}
+	return len(entries), nil
+}
+
+// audit records an action on a task, on behalf of the caller of the request,
+// or of the scheduler itself when r is nil
+func audit(r *http.Request, action, taskID, detail string) {
+	if auditor == nil {
+		return
+	}
+
+	e := &model.AuditEntry{Time: time.Now().UTC(), Action: action, TaskID: taskID, Caller: schedulerCaller, Detail: detail}
+	if r != nil {
+		e.Caller, e.RemoteAddr = requestCaller(r), r.RemoteAddr
+	}
+	if err := auditor.record(e); err != nil {
+		log.Printf("cannot record %s of task %s in audit log: %s", action, taskID, err)
+	}
+}
+
+func requestCaller(r *http.Request) string {
+	if caller, ok := r.Context().Value(callerKey{}).(string); ok && caller != "" {
+		return caller
+	}
+	return "anonymous"
+}
+
+func listAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, r, verbAudit, "", "") {
+		return
+	}
+	if auditor == nil {
+		http.Error(w, "audit log disabled", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now().UTC()
+	from, err := getTimeParam(r.FormValue("from"), now, time.Time{}, time.UTC)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "invalid duration or time for 'from' param", http.StatusBadRequest)
+		return
+	}
+	to, err := getTimeParam(r.FormValue("to"), now, time.Time{}, time.UTC)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "invalid duration or time for 'to' param", http.StatusBadRequest)
+		return
+	}
+	taskID, action, caller := r.FormValue("task"), r.FormValue("action"), r.FormValue("caller")
+
+	entries, err := auditor.entries()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filtered := make([]*model.AuditEntry, 0)
+	for _, e := range entries {
+		if taskID != "" && e.TaskID != taskID {
+			continue
+		}
+		if action != "" && e.Action != action {
+			continue
+		}
+		if caller != "" && e.Caller != caller {
+			continue
+		}
+		if !from.IsZero() && e.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !e.Time.Before(to) {
+			continue
+		}
+		filtered = append(filtered, e)
+	}
+
+	b, err := json.MarshalIndent(filtered, "", " ")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wallix/awless-scheduler/model"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{model.AuditCreate, model.AuditStart} {
+		if err = a.record(&model.AuditEntry{Time: time.Now().UTC(), Action: action, TaskID: "my_task", Caller: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the chain goes on after reopening the log
+	if a, err = openAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range []string{model.AuditEnd, model.AuditCancel} {
+		if err = a.record(&model.AuditEntry{Time: time.Now().UTC(), Action: action, TaskID: "my_task", Caller: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := verifyAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, 4; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(original, []byte("\n"))
+
+	tests := []struct {
+		name    string
+		content []byte
+		valid   int
+	}{
+		{"altered entry", bytes.Replace(original, []byte(`"Caller":"alice"`), []byte(`"Caller":"bob"`), 1), 0},
+		{"removed entry", bytes.Join(append(lines[:2:2], lines[3:]...), nil), 2},
+		{"rehashed entry", rehashed(t, path, 1), 2},
+	}
+	for _, tcase := range tests {
+		t.Run(tcase.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(path, tcase.content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			n, err := verifyAuditLog(path)
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if got, want := n, tcase.valid; got != want {
+				t.Fatalf("got %d, want %d (%s)", got, want, err)
+			}
+		})
+	}
+}
+
+// rehashed alters an entry and recomputes its hash, which breaks the link with the next entry
+func rehashed(t *testing.T, path string, index int) []byte {
+	entries, err := readAuditEntries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries[index].Caller = "bob"
+	if entries[index].Hash, err = auditHash(entries[index]); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(append(b, '\n'))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wallix/awless-scheduler/model"
+)
+
+var (
+	errTokenNotFound = errors.New("token not found")
+	errTokenExists   = errors.New("token name already used")
+)
+
+// nil when no tokens file is loaded
+var tokens *tokenStore
+
+// tokenStore keeps the hashes of the API tokens in a JSON file, reloaded
+// when changed by another process (such as --issue-token)
+type tokenStore struct {
+	mux      sync.Mutex
+	path     string
+	tokens   []*model.Token
+	loadedAt time.Time
+}
+
+func openTokenStore(path string) (*tokenStore, error) {
+	s := &tokenStore{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *tokenStore) reload() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.loadedAt) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var list []*model.Token
+	if err = json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("cannot read tokens file %s: %s", s.path, err)
+	}
+	s.tokens, s.loadedAt = list, info.ModTime()
+	return nil
+}
+
+// issue creates a token and returns it with its secret
+func (s *tokenStore) issue(name string, admin bool) (*model.Token, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("cannot generate token: %s", err)
+	}
+	id, err := newTaskID()
+	if err != nil {
+		return nil, err
+	}
+	tk := &model.Token{ID: id, Name: name, Admin: admin, Hash: hashToken(hex.EncodeToString(secret)), CreatedAt: time.Now().UTC()}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	for _, existing := range s.tokens {
+		if existing.Name == name {
+			return nil, errTokenExists
+		}
+	}
+	if err := s.save(append(s.tokens, tk)); err != nil {
+		return nil, err
+	}
+	s.tokens = append(s.tokens, tk)
+
+	issued := *tk
+	issued.Secret, issued.Hash = hex.EncodeToString(secret), ""
+	return &issued, nil
+}
+
+func (s *tokenStore) revoke(id string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err := s.reload(); err != nil {
+		return err
+	}
+	for i, tk := range s.tokens {
+		if tk.ID != id {
+			continue
+		}
+		remaining := append(append([]*model.Token{}, s.tokens[:i]...), s.tokens[i+1:]...)
+		if err := s.save(remaining); err != nil {
+			return err
+		}
+		s.tokens = remaining
+		return nil
+	}
+	return errTokenNotFound
+}
+
+// list returns the tokens without their hash
+func (s *tokenStore) list() []*model.Token {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err := s.reload(); err != nil {
+		log.Println(err)
+	}
+	list := make([]*model.Token, 0, len(s.tokens))
+	for _, tk := range s.tokens {
+		listed := *tk
+		listed.Hash = ""
+		list = append(list, &listed)
+	}
+	return list
+}
+
+// authenticate returns the token matching the secret, nil if none
+func (s *tokenStore) authenticate(secret string) *model.Token {
+	if secret == "" {
+		return nil
+	}
+	hash := []byte(hashToken(secret))
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err := s.reload(); err != nil {
+		log.Println(err)
+	}
+	for _, tk := range s.tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(tk.Hash)) == 1 {
+			return tk
+		}
+	}
+	return nil
+}
+
+func (s *tokenStore) save(list []*model.Token) error {
+	b, err := json.MarshalIndent(list, "", " ")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomically(s.path, b); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.loadedAt = info.ModTime()
+	}
+	return nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+type adminKey struct{}
+
+// requireToken rejects the requests without a valid bearer token or verified
+// client certificate. The token name, or else the certificate common name,
+// identifies the caller.
+func requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var caller string
+		var admin bool
+		if tk := tokens.authenticate(bearerToken(r)); tk != nil {
+			caller, admin = tk.Name, tk.Admin
+		} else {
+			caller = clientCertName(r)
+		}
+		if caller == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="awless-scheduler"`)
+			http.Error(w, "missing or invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), callerKey{}, caller)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, adminKey{}, admin)))
+	})
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// adminToken answers 403 unless the request is authenticated with an admin
+// token, which the unix socket mode never is
+func adminToken(w http.ResponseWriter, r *http.Request) bool {
+	if admin, _ := r.Context().Value(adminKey{}).(bool); !admin {
+		http.Error(w, "admin token required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	if tokens == nil {
+		http.Error(w, "authentication disabled", http.StatusNotFound)
+		return
+	}
+	if !adminToken(w, r) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		issueToken(w, r)
+		return
+	} else if r.Method == http.MethodGet {
+		listTokens(w, r)
+		return
+	}
+	http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+}
+
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if tokens == nil {
+		http.Error(w, "authentication disabled", http.StatusNotFound)
+		return
+	}
+	if !adminToken(w, r) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/tokens/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := tokens.revoke(id)
+	if err == errTokenNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(r, model.AuditRevokeToken, "", fmt.Sprintf("token %s", id))
+}
+
+func issueToken(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "missing 'name' param", http.StatusBadRequest)
+		return
+	}
+	var admin bool
+	if param := r.FormValue("admin"); param != "" {
+		var err error
+		if admin, err = strconv.ParseBool(param); err != nil {
+			http.Error(w, "invalid boolean for 'admin' param", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tk, err := tokens.issue(name, admin)
+	if err == errTokenExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(r, model.AuditIssueToken, "", fmt.Sprintf("token %s name=%s admin=%t", tk.ID, tk.Name, tk.Admin))
+
+	b, err := json.MarshalIndent(tk, "", " ")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func listTokens(w http.ResponseWriter, r *http.Request) {
+	b, err := json.MarshalIndent(tokens.list(), "", " ")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wallix/awless-scheduler/client"
+	"github.com/wallix/awless-scheduler/model"
+)
+
+func TestTokenAuth(t *testing.T) {
+	taskStore = createTmpStore("fs")
+	defer taskStore.Destroy()
+
+	dir, err := ioutil.TempDir("", "tokens-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokensFile := filepath.Join(dir, "tokens.json")
+	if tokens, err = openTokenStore(tokensFile); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tokens = nil }()
+
+	admin, err := tokens.issue("admin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(requireToken(routes()))
+	defer srv.Close()
+	discovery := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(model.ServiceInfo{ServiceAddr: srv.URL, AuthRequired: true})
+	}))
+	defer discovery.Close()
+
+	newClient := func(token string) *client.Client {
+		cli, err := client.New(discovery.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cli.ServiceInfo().AuthRequired {
+			t.Fatal("expected service to require auth")
+		}
+		if token != "" {
+			cli.SetToken(token)
+		}
+		return cli
+	}
+
+	if _, err = newClient("").ListTasks(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("got %v, want 401 error", err)
+	}
+	if _, err = newClient("invalid").ListTasks(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("got %v, want 401 error", err)
+	}
+
+	adminClient := newClient(admin.Secret)
+	issued, err := adminClient.IssueToken("bob", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued.Secret == "" || issued.Hash != "" {
+		t.Fatalf("unexpected issued token %#v", issued)
+	}
+	if _, err = adminClient.IssueToken("bob", false); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Fatalf("got %v, want 409 error", err)
+	}
+
+	list, err := adminClient.ListTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(list), 2; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	for _, tk := range list {
+		if tk.Secret != "" || tk.Hash != "" {
+			t.Fatalf("unexpected secret in listed token %#v", tk)
+		}
+	}
+
+	content, err := ioutil.ReadFile(tokensFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), issued.Secret) || !strings.Contains(string(content), hashToken(issued.Secret)) {
+		t.Fatalf("expected only token hashes in tokens file, got %s", content)
+	}
+
+	bobClient := newClient(issued.Secret)
+	if _, err = bobClient.ListTasks(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bobClient.IssueToken("eve", true); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("got %v, want 403 error", err)
+	}
+
+	if err = adminClient.RevokeToken(issued.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bobClient.ListTasks(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("got %v, want 401 error", err)
+	}
+	if err = adminClient.RevokeToken(issued.ID); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("got %v, want 404 error", err)
+	}
+
+	// without token authentication, as on the unix socket, tokens cannot be managed
+	unauthenticated := httptest.NewServer(routes())
+	defer unauthenticated.Close()
+	resp, err := http.Post(unauthenticated.URL+"/tokens?name=eve&admin=true", "application/text", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusForbidden; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/wallix/awless-scheduler/model"
+	bolt "go.etcd.io/bbolt"
+)
+
+const boltFilename = "scheduler.db"
+
+var (
+	tasksBucket     = []byte("tasks")
+	failuresBucket  = []byte("failures")
+	cancelledBucket = []byte("cancelled")
+	missedBucket    = []byte("missed")
+	runAtIndex      = []byte("tasks-by-runat")
+	historyBucket   = []byte("history")
+	runsByTaskIndex = []byte("runs-by-task")
+
+	boltBuckets = [][]byte{tasksBucket, failuresBucket, cancelledBucket, missedBucket, runAtIndex, historyBucket, runsByTaskIndex}
+)
+
+type boltStore struct {
+	root string
+	db   *bolt.DB
+}
+
+func NewBoltStore(root string) (store, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("cannot make new store: %s", err)
+	}
+
+	dbPath := filepath.Join(root, boltFilename)
+	_, statErr := os.Stat(dbPath)
+	created := os.IsNotExist(statErr)
+
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cannot make new store: %s", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		return createBuckets(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot make new store: %s", err)
+	}
+
+	bs := &boltStore{root: root, db: db}
+	if created {
+		if err = bs.importFSStore(); err != nil {
+			db.Close()
+			os.Remove(dbPath)
+			return nil, fmt.Errorf("cannot make new store: %s", err)
+		}
+	}
+	return bs, nil
+}
+
+// importFSStore copies the documents of an existing fs store in the same root
+// into a new database, so that switching backend keeps pending tasks. The fs
+// files are left untouched.
+func (bs *boltStore) importFSStore() error {
+	if _, err := os.Stat(filepath.Join(bs.root, "tasks")); os.IsNotExist(err) {
+		return nil
+	}
+	fs, err := NewFSStore(bs.root)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	var count int
+	for _, src := range []struct {
+		bucket []byte
+		get    func() ([]*model.Task, error)
+	}{
+		{tasksBucket, fs.GetTasks},
+		{failuresBucket, fs.GetFailures},
+		{cancelledBucket, fs.GetCancelled},
+		{missedBucket, fs.GetMissed},
+	} {
+		tasks, err := src.get()
+		if err != nil {
+			return err
+		}
+		err = bs.db.Update(func(tx *bolt.Tx) error {
+			for _, tk := range tasks {
+				if bytes.Equal(src.bucket, tasksBucket) {
+					if err := boltPutTask(tx, tk); err != nil {
+						return err
+					}
+					continue
+				}
+				b, err := marshalTaskDocument(tk)
+				if err != nil {
+					return err
+				}
+				if err = tx.Bucket(src.bucket).Put([]byte(tk.ID), b); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		count += len(tasks)
+	}
+
+	runs, err := fs.GetHistory(time.Time{}, time.Time{})
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		if err = bs.AddRun(run); err != nil {
+			return err
+		}
+	}
+
+	if count > 0 || len(runs) > 0 {
+		log.Printf("imported %d tasks and %d runs from the fs store in %s", count, len(runs), bs.root)
+	}
+	return nil
+}
+
+func (bs *boltStore) Create(tk *model.Task) error {
+	if tk.ID == "" {
+		id, err := newTaskID()
+		if err != nil {
+			return err
+		}
+		tk.ID = id
+	}
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(tasksBucket).Get([]byte(tk.ID)) != nil {
+			return fmt.Errorf("cannot create task: task %s already exists", tk.ID)
+		}
+		return boltPutTask(tx, tk)
+	})
+}
+
+func (bs *boltStore) Get(id string) (tk *model.Task, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		tk, err = boltGetTask(tx.Bucket(tasksBucket), id)
+		return err
+	})
+	return
+}
+
+func (bs *boltStore) Update(tk *model.Task) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if err := boltDeleteTask(tx, tk.ID); err != nil {
+			return err
+		}
+		return boltPutTask(tx, tk)
+	})
+}
+
+func (bs *boltStore) Remove(id string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return boltDeleteTask(tx, id)
+	})
+}
+
+func (bs *boltStore) GetTasks() ([]*model.Task, error) {
+	tasks := make([]*model.Task, 0)
+
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tasksBucket)
+		return tx.Bucket(runAtIndex).ForEach(func(_, id []byte) error {
+			tk, err := boltGetTask(b, string(id))
+			if err != nil {
+				return err
+			}
+			tasks = append(tasks, tk)
+			return nil
+		})
+	})
+
+	return tasks, err
+}
+
+func (bs *boltStore) GetFailures() ([]*model.Task, error) {
+	return bs.getAll(failuresBucket)
+}
+
+func (bs *boltStore) GetCancelled() ([]*model.Task, error) {
+	return bs.getAll(cancelledBucket)
+}
+
+func (bs *boltStore) MarkAsFailed(id string) error {
+	return bs.moveTask(id, failuresBucket)
+}
+
+func (bs *boltStore) GetFailure(id string) (tk *model.Task, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		tk, err = boltGetTask(tx.Bucket(failuresBucket), id)
+		return err
+	})
+	return
+}
+
+func (bs *boltStore) RemoveFailure(id string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(failuresBucket)
+		if b.Get([]byte(id)) == nil {
+			return errTaskNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+func (bs *boltStore) Requeue(tk *model.Task) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(failuresBucket)
+		if b.Get([]byte(tk.ID)) == nil {
+			return errTaskNotFound
+		}
+		if err := b.Delete([]byte(tk.ID)); err != nil {
+			return err
+		}
+		return boltPutTask(tx, tk)
+	})
+}
+
+func (bs *boltStore) MarkAsCancelled(id string) error {
+	return bs.moveTask(id, cancelledBucket)
+}
+
+func (bs *boltStore) GetMissed() ([]*model.Task, error) {
+	return bs.getAll(missedBucket)
+}
+
+func (bs *boltStore) MarkAsMissed(id string) error {
+	return bs.moveTask(id, missedBucket)
+}
+
+// AddRun stores runs keyed by start time, with an index keyed by task then start time
+func (bs *boltStore) AddRun(run *model.Run) error {
+	b, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		key := timeKey(run.StartedAt, run.TaskID)
+		if err := tx.Bucket(historyBucket).Put(key, b); err != nil {
+			return err
+		}
+		return tx.Bucket(runsByTaskIndex).Put(append(runsByTaskPrefix(run.TaskID), key...), key)
+	})
+}
+
+func (bs *boltStore) GetRuns(taskID string) ([]*model.Run, error) {
+	runs := make([]*model.Run, 0)
+
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket(historyBucket)
+		prefix := runsByTaskPrefix(taskID)
+		c := tx.Bucket(runsByTaskIndex).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			run := &model.Run{}
+			if err := json.Unmarshal(history.Get(v), run); err != nil {
+				return err
+			}
+			runs = append(runs, run)
+		}
+		return nil
+	})
+
+	return runs, err
+}
+
+func (bs *boltStore) GetHistory(from, to time.Time) ([]*model.Run, error) {
+	runs := make([]*model.Run, 0)
+
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(historyBucket).Cursor()
+		k, v := c.First()
+		if !from.IsZero() {
+			k, v = c.Seek(timeKey(from, ""))
+		}
+		for ; k != nil; k, v = c.Next() {
+			run := &model.Run{}
+			if err := json.Unmarshal(v, run); err != nil {
+				return err
+			}
+			if !inTimeRange(run.StartedAt, from, to) {
+				break
+			}
+			runs = append(runs, run)
+		}
+		return nil
+	})
+
+	return runs, err
+}
+
+func (bs *boltStore) Cleanup() error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return createBuckets(tx)
+	})
+}
+
+func (bs *boltStore) Close() error {
+	return bs.db.Close()
+}
+
+func (bs *boltStore) Destroy() error {
+	bs.db.Close()
+	return os.RemoveAll(bs.root)
+}
+
+func (bs *boltStore) getAll(bucket []byte) ([]*model.Task, error) {
+	tasks := make([]*model.Task, 0)
+
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(_, v []byte) error {
+			tk, err := unmarshalTaskDocument(v)
+			if err != nil {
+				return err
+			}
+			tasks = append(tasks, tk)
+			return nil
+		})
+	})
+
+	return tasks, err
+}
+
+func (bs *boltStore) moveTask(id string, bucket []byte) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		tk, err := boltGetTask(tx.Bucket(tasksBucket), id)
+		if err != nil {
+			return err
+		}
+		if err = boltDeleteTask(tx, id); err != nil {
+			return err
+		}
+		b, err := marshalTaskDocument(tk)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(bucket).Put([]byte(id), b)
+	})
+}
+
+func createBuckets(tx *bolt.Tx) error {
+	for _, name := range boltBuckets {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boltGetTask(b *bolt.Bucket, id string) (*model.Task, error) {
+	v := b.Get([]byte(id))
+	if v == nil {
+		return nil, errTaskNotFound
+	}
+	return unmarshalTaskDocument(v)
+}
+
+func boltPutTask(tx *bolt.Tx, tk *model.Task) error {
+	b, err := marshalTaskDocument(tk)
+	if err != nil {
+		return err
+	}
+	if err = tx.Bucket(tasksBucket).Put([]byte(tk.ID), b); err != nil {
+		return err
+	}
+	return tx.Bucket(runAtIndex).Put(timeKey(tk.RunAt, tk.ID), []byte(tk.ID))
+}
+
+func boltDeleteTask(tx *bolt.Tx, id string) error {
+	tk, err := boltGetTask(tx.Bucket(tasksBucket), id)
+	if err != nil {
+		return err
+	}
+	if err = tx.Bucket(runAtIndex).Delete(timeKey(tk.RunAt, tk.ID)); err != nil {
+		return err
+	}
+	return tx.Bucket(tasksBucket).Delete([]byte(id))
+}
+
+// timeKey sorts keys by time, flipping the sign bit to keep times before 1970 first
+func timeKey(t time.Time, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano())^(1<<63))
+	return append(key, id...)
+}
+
+func runsByTaskPrefix(taskID string) []byte {
+	return append([]byte(taskID), 0)
+}
@@ -1,13 +1,17 @@
 package client
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,7 +25,16 @@ type Client struct {
 }
 
 func New(discoveryURL string) (*Client, error) {
+	return NewTLS(discoveryURL, nil)
+}
+
+// NewTLS creates a client trusting the root CAs and presenting the client
+// certificates of the TLS config, for services served over HTTPS
+func NewTLS(discoveryURL string, tlsConfig *tls.Config) (*Client, error) {
 	httpClient := &http.Client{Timeout: 3 * time.Second}
+	if tlsConfig != nil {
+		httpClient.Transport = &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+	}
 	resp, err := httpClient.Get(discoveryURL)
 	if err != nil {
 		return nil, err
@@ -55,6 +68,30 @@ func New(discoveryURL string) (*Client, error) {
 	}, nil
 }
 
+// LoadTLSConfig builds a TLS config trusting the CA file, when not empty, and
+// presenting the client certificate, when its files are not empty
+func LoadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
 func newUnixSock(u string) *Client {
 	return &Client{
 		ServiceURL: &url.URL{Host: "unixsock", Scheme: "http"}, // context info only
@@ -69,11 +106,40 @@ func newUnixSock(u string) *Client {
 	}
 }
 
+// Form describes a template to schedule. Absolute RunAt and RevertAt
+// take precedence over the relative RunIn and RevertIn durations.
+// Timezone is an IANA name used to evaluate Cron.
+// Zero fields of Retry and Misfire, and a zero Timeout, take the server defaults.
+// RollbackOnFailure reverts at once the commands that succeeded in a failed execution.
 type Form struct {
 	Region, RunIn, RevertIn string
+	RunAt, RevertAt         time.Time
+	Cron, Timezone          string
+	Retry                   model.RetryPolicy
+	Misfire                 model.MisfirePolicy
+	Timeout                 time.Duration
+	RollbackOnFailure       bool
 	Template                string
 }
 
+type RescheduleForm struct {
+	RunIn, RevertIn string
+	RunAt, RevertAt time.Time
+}
+
+func addTimeParams(query url.Values, runIn, revertIn string, runAt, revertAt time.Time) {
+	if !runAt.IsZero() {
+		query.Add("run", runAt.Format(time.RFC3339))
+	} else if runIn != "" {
+		query.Add("run", runIn)
+	}
+	if !revertAt.IsZero() {
+		query.Add("revert", revertAt.Format(time.RFC3339))
+	} else if revertIn != "" {
+		query.Add("revert", revertIn)
+	}
+}
+
 func (c *Client) Ping() error {
 	addr := *c.ServiceURL
 
@@ -90,11 +156,141 @@ func (c *Client) ServiceInfo() model.ServiceInfo {
 	return *c.serviceInfo
 }
 
+// SetToken sends the token as bearer on every request, as needed by a service
+// whose info says AuthRequired
+func (c *Client) SetToken(token string) {
+	c.httpClient.Transport = &tokenTransport{token: token, next: c.httpClient.Transport}
+}
+
+type tokenTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	authReq := new(http.Request)
+	*authReq = *req
+	authReq.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		authReq.Header[k] = v
+	}
+	authReq.Header.Set("Authorization", "Bearer "+t.token)
+
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return next.RoundTrip(authReq)
+}
+
 func (c *Client) ListTasks() ([]*model.Task, error) {
+	return c.listTasks("tasks")
+}
+
+func (c *Client) ListFailures() ([]*model.Task, error) {
+	return c.listTasks("failures")
+}
+
+func (c *Client) ListCancelled() ([]*model.Task, error) {
+	return c.listTasks("cancelled")
+}
+
+func (c *Client) ListMissed() ([]*model.Task, error) {
+	return c.listTasks("missed")
+}
+
+func (c *Client) ListRuns(taskID string) ([]*model.Run, error) {
+	return c.listRuns("tasks/"+taskID+"/runs", nil)
+}
+
+// History lists the runs started in [from, to). A zero time leaves the range open.
+func (c *Client) History(from, to time.Time) ([]*model.Run, error) {
+	query := make(url.Values)
+	if !from.IsZero() {
+		query.Add("from", from.Format(time.RFC3339Nano))
+	}
+	if !to.IsZero() {
+		query.Add("to", to.Format(time.RFC3339Nano))
+	}
+	return c.listRuns("history", query)
+}
+
+// AuditFilter restricts the audit entries to a task, an action, a caller and
+// a time range when not empty
+type AuditFilter struct {
+	TaskID, Action, Caller string
+	From, To               time.Time
+}
+
+func (c *Client) Audit(filter AuditFilter) ([]*model.AuditEntry, error) {
+	var entries []*model.AuditEntry
+
+	query := make(url.Values)
+	if filter.TaskID != "" {
+		query.Add("task", filter.TaskID)
+	}
+	if filter.Action != "" {
+		query.Add("action", filter.Action)
+	}
+	if filter.Caller != "" {
+		query.Add("caller", filter.Caller)
+	}
+	if !filter.From.IsZero() {
+		query.Add("from", filter.From.Format(time.RFC3339Nano))
+	}
+	if !filter.To.IsZero() {
+		query.Add("to", filter.To.Format(time.RFC3339Nano))
+	}
+
+	addr := *c.ServiceURL
+	addr.Path = "audit"
+	addr.RawQuery = query.Encode()
+
+	resp, err := c.httpClient.Get(addr.String())
+	if err != nil {
+		return entries, err
+	}
+	defer resp.Body.Close()
+
+	if err = notOKStatus(addr.String(), resp); err != nil {
+		return entries, err
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return entries, err
+	}
+	return entries, nil
+}
+
+func (c *Client) listRuns(path string, query url.Values) ([]*model.Run, error) {
+	var runs []*model.Run
+
+	addr := *c.ServiceURL
+	addr.Path = path
+	addr.RawQuery = query.Encode()
+
+	resp, err := c.httpClient.Get(addr.String())
+	if err != nil {
+		return runs, err
+	}
+	defer resp.Body.Close()
+
+	if err = notOKStatus(addr.String(), resp); err != nil {
+		return runs, err
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&runs); err != nil {
+		return runs, err
+	}
+
+	return runs, nil
+}
+
+func (c *Client) listTasks(path string) ([]*model.Task, error) {
 	var tasks []*model.Task
 
 	addr := *c.ServiceURL
-	addr.Path = "tasks"
+	addr.Path = path
 
 	resp, err := c.httpClient.Get(addr.String())
 	if err != nil {
@@ -113,13 +309,128 @@ func (c *Client) ListTasks() ([]*model.Task, error) {
 	return tasks, nil
 }
 
-func (c *Client) ListFailures() ([]*model.Task, error) {
+func (c *Client) GetTask(id string) (*model.Task, error) {
+	addr := *c.ServiceURL
+	addr.Path = "tasks/" + id
+
+	resp, err := c.httpClient.Get(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err = notOKStatus(addr.String(), resp); err != nil {
+		return nil, err
+	}
+
+	tk := &model.Task{}
+	if err = json.NewDecoder(resp.Body).Decode(tk); err != nil {
+		return nil, err
+	}
+
+	return tk, nil
+}
+
+func (c *Client) DeleteTask(id string) error {
+	addr := *c.ServiceURL
+	addr.Path = "tasks/" + id
+
+	req, err := http.NewRequest(http.MethodDelete, addr.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return notOKStatus(addr.String(), resp)
+}
+
+func (c *Client) Reschedule(id string, f RescheduleForm) (*model.Task, error) {
+	addr := *c.ServiceURL
+	addr.Path = "tasks/" + id
+	query := addr.Query()
+	addTimeParams(query, f.RunIn, f.RevertIn, f.RunAt, f.RevertAt)
+	addr.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodPatch, addr.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err = notOKStatus(addr.String(), resp); err != nil {
+		return nil, err
+	}
+
+	tk := &model.Task{}
+	if err = json.NewDecoder(resp.Body).Decode(tk); err != nil {
+		return nil, err
+	}
+
+	return tk, nil
+}
+
+func (c *Client) Cancel(id string) error {
+	return c.cancel(id, false)
+}
+
+// CancelWithReverts cancels a task along with its pending revert tasks
+func (c *Client) CancelWithReverts(id string) error {
+	return c.cancel(id, true)
+}
+
+func (c *Client) cancel(id string, withReverts bool) error {
+	addr := *c.ServiceURL
+	addr.Path = "tasks/" + id + "/cancel"
+	if withReverts {
+		addr.RawQuery = url.Values{"reverts": {"true"}}.Encode()
+	}
+
+	resp, err := c.httpClient.Post(addr.String(), "application/text", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return notOKStatus(addr.String(), resp)
+}
+
+// Abort interrupts a running task. The commands that succeeded are reverted at
+// the form revert time, or at the task revert time if none; run fields are ignored.
+func (c *Client) Abort(id string, f RescheduleForm) error {
+	addr := *c.ServiceURL
+	addr.Path = "tasks/" + id + "/abort"
+	query := addr.Query()
+	addTimeParams(query, "", f.RevertIn, time.Time{}, f.RevertAt)
+	addr.RawQuery = query.Encode()
+
+	resp, err := c.httpClient.Post(addr.String(), "application/text", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return notOKStatus(addr.String(), resp)
+}
+
+// RevertNow runs the pending reverts of a task now or, if it has none, reverts its
+// last execution. It returns the revert tasks.
+func (c *Client) RevertNow(id string) ([]*model.Task, error) {
 	var tasks []*model.Task
 
 	addr := *c.ServiceURL
-	addr.Path = "failures"
+	addr.Path = "tasks/" + id + "/revert-now"
 
-	resp, err := c.httpClient.Get(addr.String())
+	resp, err := c.httpClient.Post(addr.String(), "application/text", nil)
 	if err != nil {
 		return tasks, err
 	}
@@ -136,16 +447,159 @@ func (c *Client) ListFailures() ([]*model.Task, error) {
 	return tasks, nil
 }
 
+// RetryFailure requeues a failed task, to run now unless the form says otherwise.
+// Without revert time, the task keeps its delay before revert.
+func (c *Client) RetryFailure(id string, f RescheduleForm) (*model.Task, error) {
+	addr := *c.ServiceURL
+	addr.Path = "failures/" + id + "/retry"
+	query := addr.Query()
+	addTimeParams(query, f.RunIn, f.RevertIn, f.RunAt, f.RevertAt)
+	addr.RawQuery = query.Encode()
+
+	resp, err := c.httpClient.Post(addr.String(), "application/text", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err = notOKStatus(addr.String(), resp); err != nil {
+		return nil, err
+	}
+
+	tk := &model.Task{}
+	if err = json.NewDecoder(resp.Body).Decode(tk); err != nil {
+		return nil, err
+	}
+
+	return tk, nil
+}
+
+func (c *Client) DeleteFailure(id string) error {
+	addr := *c.ServiceURL
+	addr.Path = "failures/" + id
+
+	req, err := http.NewRequest(http.MethodDelete, addr.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return notOKStatus(addr.String(), resp)
+}
+
+// IssueToken creates a token, admin to manage tokens. The returned token
+// carries its secret, which cannot be retrieved later.
+func (c *Client) IssueToken(name string, admin bool) (*model.Token, error) {
+	addr := *c.ServiceURL
+	addr.Path = "tokens"
+	addr.RawQuery = url.Values{"name": {name}, "admin": {strconv.FormatBool(admin)}}.Encode()
+
+	resp, err := c.httpClient.Post(addr.String(), "application/text", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err = notOKStatus(addr.String(), resp); err != nil {
+		return nil, err
+	}
+
+	tk := &model.Token{}
+	if err = json.NewDecoder(resp.Body).Decode(tk); err != nil {
+		return nil, err
+	}
+
+	return tk, nil
+}
+
+func (c *Client) ListTokens() ([]*model.Token, error) {
+	var tokens []*model.Token
+
+	addr := *c.ServiceURL
+	addr.Path = "tokens"
+
+	resp, err := c.httpClient.Get(addr.String())
+	if err != nil {
+		return tokens, err
+	}
+	defer resp.Body.Close()
+
+	if err = notOKStatus(addr.String(), resp); err != nil {
+		return tokens, err
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return tokens, err
+	}
+
+	return tokens, nil
+}
+
+func (c *Client) RevokeToken(id string) error {
+	addr := *c.ServiceURL
+	addr.Path = "tokens/" + id
+
+	req, err := http.NewRequest(http.MethodDelete, addr.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return notOKStatus(addr.String(), resp)
+}
+
+// Post schedules a template
 func (c *Client) Post(f Form) error {
+	_, err := c.PostTask(f)
+	return err
+}
+
+// PostTask schedules a template and returns the created task
+func (c *Client) PostTask(f Form) (*model.Task, error) {
 	addr := *c.ServiceURL
 	addr.Path = "tasks"
 	query := addr.Query()
 	query.Add("region", f.Region)
-	if f.RunIn != "" {
-		query.Add("run", f.RunIn)
+	addTimeParams(query, f.RunIn, f.RevertIn, f.RunAt, f.RevertAt)
+	if f.Cron != "" {
+		query.Add("cron", f.Cron)
+	}
+	if f.Timezone != "" {
+		query.Add("tz", f.Timezone)
+	}
+	if f.Retry.MaxAttempts > 0 {
+		query.Add("retry-max-attempts", strconv.Itoa(f.Retry.MaxAttempts))
 	}
-	if f.RevertIn != "" {
-		query.Add("revert", f.RevertIn)
+	if f.Retry.InitialBackoff > 0 {
+		query.Add("retry-backoff", f.Retry.InitialBackoff.String())
+	}
+	if f.Retry.Multiplier > 0 {
+		query.Add("retry-multiplier", strconv.FormatFloat(f.Retry.Multiplier, 'f', -1, 64))
+	}
+	if f.Retry.Jitter > 0 {
+		query.Add("retry-jitter", strconv.FormatFloat(f.Retry.Jitter, 'f', -1, 64))
+	}
+	if f.Misfire.Action != "" {
+		query.Add("misfire", f.Misfire.Action)
+	}
+	if f.Misfire.Window > 0 {
+		query.Add("misfire-window", f.Misfire.Window.String())
+	}
+	if f.Timeout > 0 {
+		query.Add("timeout", f.Timeout.String())
+	}
+	if f.RollbackOnFailure {
+		query.Add("rollback-on-failure", "true")
 	}
 	addr.RawQuery = query.Encode()
 
@@ -155,15 +609,110 @@ func (c *Client) Post(f Form) error {
 		strings.NewReader(f.Template),
 	)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if err := notOKStatus(addr.String(), resp); err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	tk := &model.Task{}
+	if err = json.NewDecoder(resp.Body).Decode(tk); err != nil {
+		return nil, err
+	}
+
+	return tk, nil
+}
+
+// WatchFilter restricts the watched events to a task or a region when not empty
+type WatchFilter struct {
+	TaskID, Region string
+}
+
+// Watch streams the scheduler events until the context is done or the
+// connection is lost, closing the returned channel.
+func (c *Client) Watch(ctx context.Context, f WatchFilter) (<-chan *model.Notification, error) {
+	addr := *c.ServiceURL
+	addr.Path = "events"
+	query := addr.Query()
+	if f.TaskID != "" {
+		query.Add("task", f.TaskID)
+	}
+	if f.Region != "" {
+		query.Add("region", f.Region)
+	}
+	addr.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, addr.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// the stream outlives the client timeout
+	streamClient := *c.httpClient
+	streamClient.Timeout = 0
+	resp, err := streamClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if err = notOKStatus(addr.String(), resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	events := make(chan *model.Notification)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+
+		var data []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "data:") {
+				data = append(data, strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+				continue
+			}
+			if line != "" || len(data) == 0 {
+				continue
+			}
+			n := &model.Notification{}
+			err := json.Unmarshal([]byte(strings.Join(data, "\n")), n)
+			data = nil
+			if err != nil {
+				continue
+			}
+			select {
+			case events <- n:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// WaitTask waits for the end of the next execution of a task, returning its
+// succeeded, failed, reverted or missed event
+func (c *Client) WaitTask(ctx context.Context, id string) (*model.Notification, error) {
+	events, err := c.Watch(ctx, WatchFilter{TaskID: id})
+	if err != nil {
+		return nil, err
+	}
+
+	for n := range events {
+		switch n.Event {
+		case model.EventSucceeded, model.EventFailed, model.EventReverted, model.EventMissed:
+			return n, nil
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("event stream of task %s ended", id)
 }
 
 func notOKStatus(addr string, resp *http.Response) error {
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/wallix/awless-scheduler/model"
+)
+
+const idleWait = 24 * time.Hour
+
+// dispatchedTask is a running task, with the run time it was started for
+type dispatchedTask struct {
+	region string
+	runAt  time.Time
+}
+
+// dispatcher executes tasks when due, sleeping until the next run of its queue.
+// At most workers tasks run at once, and at most regionWorkers per region (when > 0)
+type dispatcher struct {
+	mux    sync.Mutex
+	queue  taskQueue
+	queued map[string]*queuedTask
+
+	workers, regionWorkers int
+	// only accessed by the dispatcher loop
+	ready         []*model.Task
+	inFlight      map[string]dispatchedTask
+	regionRunning map[string]int
+
+	store    store
+	wakeup   chan struct{}
+	finished chan string
+	done     chan struct{}
+}
+
+func newDispatcher(s store, workers, regionWorkers int) (*dispatcher, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("invalid number of workers %d", workers)
+	}
+	d := &dispatcher{
+		queued:        make(map[string]*queuedTask),
+		workers:       workers,
+		regionWorkers: regionWorkers,
+		inFlight:      make(map[string]dispatchedTask),
+		regionRunning: make(map[string]int),
+		store:         s,
+		wakeup:        make(chan struct{}, 1),
+		finished:      make(chan string),
+		done:          make(chan struct{}),
+	}
+
+	tasks, err := s.GetTasks()
+	if err != nil {
+		return nil, err
+	}
+	for _, tk := range tasks {
+		d.schedule(tk)
+	}
+
+	return d, nil
+}
+
+func (d *dispatcher) start() {
+	for {
+		timer := time.NewTimer(d.untilNextRun())
+		var start time.Time
+		select {
+		case <-timer.C:
+			start = time.Now()
+			d.collectDueTasks()
+		case id := <-d.finished:
+			timer.Stop()
+			start = time.Now()
+			d.release(id)
+		case <-d.wakeup:
+			timer.Stop()
+			start = time.Now()
+		case <-d.done:
+			timer.Stop()
+			return
+		}
+		d.startReadyTasks()
+		metrics.observeDispatch(start)
+	}
+}
+
+func (d *dispatcher) stop() {
+	close(d.done)
+}
+
+func (d *dispatcher) schedule(tk *model.Task) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if qt, ok := d.queued[tk.ID]; ok {
+		qt.runAt = tk.NextRunAt()
+		heap.Fix(&d.queue, qt.index)
+	} else {
+		qt = &queuedTask{id: tk.ID, runAt: tk.NextRunAt()}
+		heap.Push(&d.queue, qt)
+		d.queued[tk.ID] = qt
+	}
+	d.notify()
+}
+
+func (d *dispatcher) unschedule(id string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if qt, ok := d.queued[id]; ok {
+		heap.Remove(&d.queue, qt.index)
+		delete(d.queued, id)
+		d.notify()
+	}
+}
+
+func (d *dispatcher) reset() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	d.queue = nil
+	d.queued = make(map[string]*queuedTask)
+	d.notify()
+}
+
+func (d *dispatcher) queueLen() int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	return d.queue.Len()
+}
+
+func (d *dispatcher) notify() {
+	select {
+	case d.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (d *dispatcher) untilNextRun() time.Duration {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	if len(d.queue) == 0 {
+		return idleWait
+	}
+	return time.Until(d.queue[0].runAt)
+}
+
+func (d *dispatcher) popDueTasks() (ids []string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	now := time.Now().UTC()
+	for len(d.queue) > 0 && !d.queue[0].runAt.After(now) {
+		qt := heap.Pop(&d.queue).(*queuedTask)
+		delete(d.queued, qt.id)
+		ids = append(ids, qt.id)
+	}
+	return
+}
+
+func (d *dispatcher) collectDueTasks() {
+	for _, id := range d.popDueTasks() {
+		if _, running := d.inFlight[id]; running {
+			if *debug {
+				log.Printf("task %s is still running, not dispatched", id)
+			}
+			continue
+		}
+		if tk := d.executableTask(id); tk != nil {
+			d.ready = append(d.ready, tk)
+		}
+	}
+}
+
+// startReadyTasks starts the due tasks in order, skipping the ones whose region is busy
+func (d *dispatcher) startReadyTasks() {
+	var waiting []*model.Task
+	for i, ready := range d.ready {
+		if len(d.inFlight) >= d.workers {
+			waiting = append(waiting, d.ready[i:]...)
+			break
+		}
+		if d.regionWorkers > 0 && d.regionRunning[ready.Region] >= d.regionWorkers {
+			waiting = append(waiting, ready)
+			continue
+		}
+		if _, running := d.inFlight[ready.ID]; running {
+			continue
+		}
+		// the task may have changed while waiting for a worker
+		tk := d.executableTask(ready.ID)
+		if tk == nil {
+			continue
+		}
+		d.inFlight[tk.ID] = dispatchedTask{region: tk.Region, runAt: tk.NextRunAt()}
+		d.regionRunning[tk.Region]++
+		go d.run(tk)
+	}
+	d.ready = waiting
+}
+
+func (d *dispatcher) release(id string) {
+	dispatched := d.inFlight[id]
+	delete(d.inFlight, id)
+	if d.regionRunning[dispatched.region]--; d.regionRunning[dispatched.region] <= 0 {
+		delete(d.regionRunning, dispatched.region)
+	}
+
+	// requeue the task if it was rescheduled while running. A task still due
+	// at the same time was not updated by its execution and would run again at once
+	if tk, err := d.store.Get(id); err == nil && !tk.NextRunAt().Equal(dispatched.runAt) {
+		d.schedule(tk)
+	}
+}
+
+func (d *dispatcher) executableTask(id string) *model.Task {
+	tk, err := d.store.Get(id)
+	if err == errTaskNotFound {
+		return nil
+	}
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	now := time.Now().UTC()
+	if tk.NextRunAt().After(now) {
+		d.schedule(tk)
+		return nil
+	}
+	if reason := misfireReason(tk, now); reason != "" {
+		log.Printf("task %s missed: %s", tk.ID, reason)
+		if err := missTask(tk, reason); err != nil {
+			log.Printf("cannot mark task %s as missed: %s", tk.ID, err)
+		}
+		return nil
+	}
+	return tk
+}
+
+func (d *dispatcher) run(tk *model.Task) {
+	defer func() {
+		select {
+		case d.finished <- tk.ID:
+		case <-d.done:
+		}
+	}()
+
+	evt := &event{tk: tk}
+	drv, err := driversFunc(tk.Region)
+	if err != nil {
+		evt.err = fmt.Errorf("cannot get driver for region %s: %s", tk.Region, err)
+		if failErr := failUnstartedTask(tk, evt.err); failErr != nil {
+			log.Printf("cannot mark task %s as failed: %s", tk.ID, failErr)
+		}
+		eventc <- evt
+		return
+	}
+
+	evt.tpl, evt.err = executeTask(tk, drv, compileEnvFunc())
+	eventc <- evt
+}
+
+type queuedTask struct {
+	id    string
+	runAt time.Time
+	index int
+}
+
+// taskQueue is a min-heap of tasks on their next run time
+type taskQueue []*queuedTask
+
+func (q taskQueue) Len() int           { return len(q) }
+func (q taskQueue) Less(i, j int) bool { return q[i].runAt.Before(q[j].runAt) }
+
+func (q taskQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *taskQueue) Push(x interface{}) {
+	qt := x.(*queuedTask)
+	qt.index = len(*q)
+	*q = append(*q, qt)
+}
+
+func (q *taskQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	qt := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return qt
+}
+
+// dispatchedStore keeps the dispatcher queue in sync with the pending tasks of the store
+type dispatchedStore struct {
+	store
+	d *dispatcher
+}
+
+func (s *dispatchedStore) Create(tk *model.Task) error {
+	if err := s.store.Create(tk); err != nil {
+		return err
+	}
+	s.d.schedule(tk)
+	return nil
+}
+
+func (s *dispatchedStore) Update(tk *model.Task) error {
+	if err := s.store.Update(tk); err != nil {
+		return err
+	}
+	s.d.schedule(tk)
+	return nil
+}
+
+func (s *dispatchedStore) Requeue(tk *model.Task) error {
+	if err := s.store.Requeue(tk); err != nil {
+		return err
+	}
+	s.d.schedule(tk)
+	return nil
+}
+
+func (s *dispatchedStore) Remove(id string) error {
+	if err := s.store.Remove(id); err != nil {
+		return err
+	}
+	s.d.unschedule(id)
+	return nil
+}
+
+func (s *dispatchedStore) MarkAsFailed(id string) error {
+	if err := s.store.MarkAsFailed(id); err != nil {
+		return err
+	}
+	s.d.unschedule(id)
+	return nil
+}
+
+func (s *dispatchedStore) MarkAsCancelled(id string) error {
+	if err := s.store.MarkAsCancelled(id); err != nil {
+		return err
+	}
+	s.d.unschedule(id)
+	return nil
+}
+
+func (s *dispatchedStore) MarkAsMissed(id string) error {
+	if err := s.store.MarkAsMissed(id); err != nil {
+		return err
+	}
+	s.d.unschedule(id)
+	return nil
+}
+
+func (s *dispatchedStore) Cleanup() error {
+	s.d.reset()
+	return s.store.Cleanup()
+}
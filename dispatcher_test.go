@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wallix/awless-scheduler/model"
+	"github.com/wallix/awless/template"
+	"github.com/wallix/awless/template/driver"
+)
+
+func TestDispatcher(t *testing.T) {
+	for _, backend := range storeBackends {
+		t.Run(backend, func(t *testing.T) {
+			s := createTmpStore(backend)
+			defer s.Destroy()
+
+			d, err := newDispatcher(s, 1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			taskStore = &dispatchedStore{store: s, d: d}
+
+			now := time.Now().UTC()
+
+			// never run
+			taskStore.Create(&model.Task{
+				Content: "#I will never run because I'm to old",
+				RunAt:   now.Add(-80 * time.Minute), RevertAt: now,
+				Region: "us-west-1",
+			})
+			taskStore.Create(&model.Task{
+				Content: "create instance name=tata",
+				RunAt:   now.Add(-5 * time.Minute), RevertAt: now.Add(1 * time.Second),
+				Region: "us-west-1",
+			})
+			taskStore.Create(&model.Task{
+				Content: "delete instance id=toto",
+				RunAt:   now.Add(-1 * time.Minute),
+				Region:  "us-west-1",
+			})
+			taskStore.Create(&model.Task{
+				Content: "create group unexisting=nothing",
+				RunAt:   now.Add(-1 * time.Second),
+				Region:  "us-west-1",
+			})
+			taskStore.Create(&model.Task{
+				Content: "create subnet cidr=10.0.0.0/24",
+				RunAt:   now.Add(2 * time.Second),
+				Region:  "us-west-1",
+			})
+			taskStore.Create(&model.Task{
+				Content: "#test will stop before I run",
+				RunAt:   now.Add(30 * time.Minute),
+				Region:  "us-west-1",
+			})
+
+			compileEnvFunc = func() *template.Env {
+				return newTemplateEnv(func(key string) (template.Definition, bool) {
+					if key == "creategroup" {
+						return template.Definition{}, false
+					}
+					return template.Definition{ExtraParams: []string{"id", "name", "cidr"}}, true
+				})
+			}
+
+			driversFunc = func(region string) (driver.Driver, error) {
+				return &happyDriver{}, nil
+			}
+
+			go d.start()
+			assertEventContainsMsg(t, <-eventc, "success for create instance name=tata")
+			assertEventContainsMsg(t, <-eventc, "success for delete instance id=toto")
+			assertEventContainsMsg(t, <-eventc, "failure: cannot find template definition for 'creategroup'")
+			assertEventContainsMsg(t, <-eventc, "success for delete instance id=tata")
+			assertEventContainsMsg(t, <-eventc, "success for create subnet cidr=10.0.0.0/24")
+			d.stop()
+
+			missed, err := taskStore.GetMissed()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(missed), 1; got != want {
+				t.Fatalf("got %d, want %d", got, want)
+			}
+			if missed[0].Missed == nil || missed[0].Missed.Reason == "" {
+				t.Fatal("expected missed reason")
+			}
+			runs, err := taskStore.GetRuns(missed[0].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(runs), 1; got != want {
+				t.Fatalf("got %d, want %d", got, want)
+			}
+			if got, want := runs[0].Status, model.RunMissed; got != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestDispatcherFollowsStoreChanges(t *testing.T) {
+	for _, backend := range storeBackends {
+		t.Run(backend, func(t *testing.T) {
+			s := createTmpStore(backend)
+			defer s.Destroy()
+
+			d, err := newDispatcher(s, 4, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			taskStore = &dispatchedStore{store: s, d: d}
+
+			compileEnvFunc = func() *template.Env {
+				return newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{ExtraParams: []string{"name"}}, true
+				})
+			}
+			driversFunc = func(region string) (driver.Driver, error) {
+				return &happyDriver{}, nil
+			}
+
+			go d.start()
+			defer d.stop()
+
+			now := time.Now().UTC()
+			cancelled := &model.Task{Content: "create instance name=cancelled", RunAt: now.Add(200 * time.Millisecond), Region: "us-west-1"}
+			if err := taskStore.Create(cancelled); err != nil {
+				t.Fatal(err)
+			}
+			rescheduled := &model.Task{Content: "create instance name=rescheduled", RunAt: now.Add(1 * time.Hour), Region: "us-west-1"}
+			if err := taskStore.Create(rescheduled); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := d.queueLen(), 2; got != want {
+				t.Fatalf("got %d, want %d", got, want)
+			}
+
+			if err := taskStore.MarkAsCancelled(cancelled.ID); err != nil {
+				t.Fatal(err)
+			}
+			rescheduled.RunAt = now.Add(400 * time.Millisecond)
+			if err := taskStore.Update(rescheduled); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case evt := <-eventc:
+				assertEventContainsMsg(t, evt, "success for create instance name=rescheduled")
+				if late := time.Since(rescheduled.RunAt); late > 500*time.Millisecond {
+					t.Fatalf("dispatched %s late", late)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("rescheduled task was not dispatched")
+			}
+
+			if got, want := d.queueLen(), 0; got != want {
+				t.Fatalf("got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestDispatcherFailsTaskWithoutDriver(t *testing.T) {
+	s := createTmpStore("fs")
+	defer s.Destroy()
+
+	d, err := newDispatcher(s, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskStore = &dispatchedStore{store: s, d: d}
+
+	var mux sync.Mutex
+	var calls int
+	driversFunc = func(region string) (driver.Driver, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		calls++
+		return nil, errors.New("no credentials")
+	}
+
+	tk := &model.Task{Content: "create instance name=nodriver", RunAt: time.Now().UTC().Add(-time.Second), Region: "us-west-1",
+		Retry: model.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Hour, Multiplier: 1}}
+	if err := taskStore.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+
+	go d.start()
+	defer d.stop()
+
+	select {
+	case evt := <-eventc:
+		assertEventContainsMsg(t, evt, "failure: cannot get driver for region us-west-1: no credentials")
+	case <-time.After(5 * time.Second):
+		t.Fatal("task was not dispatched")
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	mux.Lock()
+	if got, want := calls, 1; got != want {
+		t.Fatalf("got %d driver calls, want %d", got, want)
+	}
+	mux.Unlock()
+
+	failed, err := s.Get(tk.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := failed.Attempts, 1; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	if failed.Failure == nil || failed.Failure.Error != "cannot get driver for region us-west-1: no credentials" {
+		t.Fatalf("got failure %#v", failed.Failure)
+	}
+	if !failed.NextAttemptAt.After(time.Now()) {
+		t.Fatalf("got next attempt at %s, want a future time", failed.NextAttemptAt)
+	}
+	runs, err := s.GetRuns(tk.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(runs), 1; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	if got, want := d.queueLen(), 1; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+}
+
+func TestDispatcherLimitsConcurrency(t *testing.T) {
+	s := createTmpStore("fs")
+	defer s.Destroy()
+
+	d, err := newDispatcher(s, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	taskStore = &dispatchedStore{store: s, d: d}
+
+	compileEnvFunc = func() *template.Env {
+		return newTemplateEnv(func(key string) (template.Definition, bool) {
+			return template.Definition{ExtraParams: []string{"name"}}, true
+		})
+	}
+	drv := &blockingDriver{release: make(chan struct{}), running: make(map[string]int), maxRunning: make(map[string]int)}
+	driversFunc = func(region string) (driver.Driver, error) {
+		return &regionDriver{blockingDriver: drv, region: region}, nil
+	}
+
+	now := time.Now().UTC()
+	for _, tk := range []*model.Task{
+		{Content: "create instance name=one", RunAt: now.Add(-3 * time.Second), Region: "us-west-1"},
+		{Content: "create instance name=two", RunAt: now.Add(-2 * time.Second), Region: "us-west-1"},
+		{Content: "create instance name=three", RunAt: now.Add(-1 * time.Second), Region: "eu-west-1"},
+	} {
+		if err := taskStore.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go d.start()
+	defer d.stop()
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		select {
+		case drv.release <- struct{}{}:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no task running")
+		}
+		select {
+		case evt := <-eventc:
+			assertEventContainsMsg(t, evt, "success")
+		case <-time.After(5 * time.Second):
+			t.Fatal("tasks were not all dispatched")
+		}
+	}
+
+	drv.mux.Lock()
+	defer drv.mux.Unlock()
+	if got, want := drv.maxRunning["us-west-1"], 1; got != want {
+		t.Fatalf("got %d concurrent tasks in us-west-1, want %d", got, want)
+	}
+	if got, want := drv.maxTotal, 2; got != want {
+		t.Fatalf("got %d concurrent tasks, want %d", got, want)
+	}
+}
+
+func assertEventContainsMsg(t *testing.T, ev *event, msg string) {
+	if !strings.Contains(ev.String(), msg) {
+		t.Fatalf("expected '%s' to contain '%s'", ev, msg)
+	}
+}
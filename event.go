@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-
 	"log"
+	"net/http"
+	"sync"
 
 	"github.com/wallix/awless-scheduler/model"
 	"github.com/wallix/awless/template"
@@ -27,3 +29,106 @@ func collectEvents() {
 		log.Println(evt)
 	}
 }
+
+var streams = &eventStreams{subscribers: make(map[chan *model.Notification]eventFilter)}
+
+type eventFilter struct {
+	taskID, region string
+}
+
+func (f eventFilter) match(n *model.Notification) bool {
+	return (f.taskID == "" || f.taskID == n.TaskID) && (f.region == "" || f.region == n.Region)
+}
+
+// eventStreams broadcasts the task notifications to the clients streaming events
+type eventStreams struct {
+	mux         sync.Mutex
+	subscribers map[chan *model.Notification]eventFilter
+}
+
+func (es *eventStreams) subscribe(f eventFilter) chan *model.Notification {
+	es.mux.Lock()
+	defer es.mux.Unlock()
+
+	c := make(chan *model.Notification, 16)
+	es.subscribers[c] = f
+	return c
+}
+
+func (es *eventStreams) unsubscribe(c chan *model.Notification) {
+	es.mux.Lock()
+	defer es.mux.Unlock()
+
+	delete(es.subscribers, c)
+}
+
+// closeAll ends the event streams, which otherwise only end when their clients
+// disconnect and would block the shutdown of the service
+func (es *eventStreams) closeAll() {
+	es.mux.Lock()
+	defer es.mux.Unlock()
+
+	for c := range es.subscribers {
+		close(c)
+		delete(es.subscribers, c)
+	}
+}
+
+// publish never blocks: slow subscribers miss the notifications
+func (es *eventStreams) publish(n *model.Notification) {
+	es.mux.Lock()
+	defer es.mux.Unlock()
+
+	for c, f := range es.subscribers {
+		if !f.match(n) {
+			continue
+		}
+		select {
+		case c <- n:
+		default:
+			log.Printf("event stream full, dropping %s event of task %s", n.Event, n.TaskID)
+		}
+	}
+}
+
+// streamEvents streams the task events as server-sent events, filtered by the 'task' and 'region' params
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	c := streams.subscribe(eventFilter{taskID: r.FormValue("task"), region: r.FormValue("region")})
+	defer streams.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case n, ok := <-c:
+			if !ok {
+				return
+			}
+			if !readable(r, n.Region, n.Owner) {
+				continue
+			}
+			b, err := json.Marshal(n)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", n.Event, b)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
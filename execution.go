@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/wallix/awless/template/driver"
+)
+
+var errExecutionAborted = errors.New("execution aborted")
+
+var (
+	executionsMux sync.Mutex
+	executions    = make(map[string]*execution)
+)
+
+// execution is a running task, cancelled when timing out or aborted
+type execution struct {
+	id     string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mux      sync.Mutex
+	aborted  bool
+	revertAt time.Time
+}
+
+func startExecution(id string, timeout time.Duration) *execution {
+	exec := &execution{id: id}
+	exec.ctx, exec.cancel = context.WithTimeout(context.Background(), timeout)
+
+	executionsMux.Lock()
+	executions[id] = exec
+	executionsMux.Unlock()
+
+	return exec
+}
+
+func (exec *execution) end() {
+	exec.cancel()
+
+	executionsMux.Lock()
+	if executions[exec.id] == exec {
+		delete(executions, exec.id)
+	}
+	executionsMux.Unlock()
+}
+
+func runningExecutions() int {
+	executionsMux.Lock()
+	defer executionsMux.Unlock()
+
+	return len(executions)
+}
+
+func (exec *execution) isAborted() bool {
+	exec.mux.Lock()
+	defer exec.mux.Unlock()
+
+	return exec.aborted
+}
+
+func (exec *execution) abortRevertAt() time.Time {
+	exec.mux.Lock()
+	defer exec.mux.Unlock()
+
+	return exec.revertAt
+}
+
+// abortExecution interrupts a running task, the commands that succeeded being
+// reverted at revertAt unless zero. It returns false if the task is not running
+func abortExecution(id string, revertAt time.Time) bool {
+	executionsMux.Lock()
+	exec, ok := executions[id]
+	executionsMux.Unlock()
+	if !ok {
+		return false
+	}
+
+	exec.mux.Lock()
+	exec.aborted, exec.revertAt = true, revertAt
+	exec.mux.Unlock()
+	exec.cancel()
+
+	return true
+}
+
+// contextDriver fails the commands once its context is done. As drivers take
+// no context, a hung command is left running in the background
+type contextDriver struct {
+	driver.Driver
+	ctx context.Context
+}
+
+func (d *contextDriver) Lookup(lookups ...string) (driver.DriverFn, error) {
+	fn, err := d.Driver.Lookup(lookups...)
+	if err != nil {
+		return fn, err
+	}
+
+	return func(ctx driver.Context, params map[string]interface{}) (interface{}, error) {
+		if err := d.ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		type result struct {
+			v   interface{}
+			err error
+		}
+		resc := make(chan result, 1)
+		go func() {
+			v, err := fn(ctx, params)
+			resc <- result{v, err}
+		}()
+
+		select {
+		case res := <-resc:
+			return res.v, res.err
+		case <-d.ctx.Done():
+			return nil, d.ctx.Err()
+		}
+	}, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"hash/adler32"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wallix/awless-scheduler/model"
+)
+
+// Before task documents, tasks were stored as their template content with all
+// metadata packed in the filename: [<id>_]<checksum>_<run>_<revert>[_<options>]_<region>.aws
+
+func migrateLegacyFiles(dirs ...string) error {
+	for _, dir := range dirs {
+		files, err := filepath.Glob(filepath.Join(dir, fmt.Sprintf("*.%s", model.AwlessFileExt)))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			tk, err := newFromLegacyFile(file)
+			if err != nil {
+				log.Printf("cannot migrate legacy task file %s: %s", file, err)
+				continue
+			}
+			if err = writeTaskFile(filepath.Join(dir, taskFilename(tk.ID)), tk); err != nil {
+				return fmt.Errorf("cannot migrate legacy task file %s: %s", file, err)
+			}
+			if err = os.Remove(file); err != nil {
+				return err
+			}
+			log.Printf("Migrated legacy task file %s to task %s", file, tk.ID)
+		}
+	}
+
+	return nil
+}
+
+func newFromLegacyFile(filePath string) (tk *model.Task, err error) {
+	tk = &model.Task{}
+
+	var content []byte
+	content, err = ioutil.ReadFile(filePath)
+	if err != nil {
+		return
+	}
+	tk.Content = string(content)
+	fileName := filepath.Base(filePath)
+	name := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	// the format is told by the field contents since the region may contain '_':
+	// the run time follows the checksum of unidentified tasks, and the options
+	// (never containing '_') are empty or hold '=' unlike regions
+	splits := strings.Split(name, "_")
+	if len(splits) < 4 {
+		err = fmt.Errorf("invalid task filename %s", fileName)
+		return
+	}
+	var opts string
+	if _, stampErr := time.Parse(model.StampLayout, splits[1]); stampErr == nil {
+		if tk.ID, err = newTaskID(); err != nil {
+			return
+		}
+	} else {
+		tk.ID, splits = splits[0], splits[1:]
+		if len(splits) > 4 && (splits[3] == "" || strings.Contains(splits[3], "=")) {
+			opts, splits = splits[3], append(splits[:3:3], splits[4:]...)
+		}
+	}
+	if len(splits) < 4 {
+		err = fmt.Errorf("invalid task filename %s", fileName)
+		return
+	}
+	splits = append(splits[:3:3], strings.Join(splits[3:], "_"))
+	checksum, err := strconv.ParseUint(splits[0], 10, 32)
+	if err != nil {
+		return
+	}
+	if cs := adler32.Checksum([]byte(tk.Content)); uint32(checksum) != cs {
+		err = fmt.Errorf("unexpected checksum for file %s. Exepcted %d", name, cs)
+		return
+	}
+	tk.RunAt, err = time.Parse(model.StampLayout, splits[1])
+	if err != nil {
+		return
+	}
+	tk.RevertAt, err = time.Parse(model.StampLayout, splits[2])
+	if err != nil {
+		return
+	}
+	tk.Region = splits[3]
+
+	var values url.Values
+	if values, err = url.ParseQuery(opts); err != nil {
+		return
+	}
+	tk.Cron = values.Get("cron")
+	tk.Timezone = values.Get("tz")
+
+	return
+}
@@ -2,18 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"os/user"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -28,43 +33,138 @@ var (
 	discoveryHostport = flag.String("discovery-hostport", "127.0.0.1:8082", "Listening host:port for the discovery service")
 	schedulerHostport = flag.String("scheduler-hostport", "127.0.0.1:8083", "Listening host:port for the scheduler service")
 	httpMode          = flag.Bool("http-mode", false, "Scheduler service on HTTP")
-	tickerFrequency   = flag.Duration("tick-frequency", 1*time.Minute, "ticker frequency to run executable tasks")
+	sockMode          = flag.String("sock-mode", "0600", "Octal file mode of the unix socket")
+	sockGroup         = flag.String("sock-group", "", "Group name or id owning the unix socket")
+	allowedUsers      = flag.String("allowed-uids", "", "Comma separated uids allowed to connect to the unix socket (any when empty)")
+	storeBackend      = flag.String("store", "fs", "Task store backend: 'fs' (one file per task) or 'bolt' (embedded transactional database)")
+	webhookURLs       = flag.String("webhooks", "", "Comma separated URLs notified of the task events")
+	webhookSecret     = flag.String("webhook-secret", "", "Secret signing the webhook payloads with HMAC-SHA256")
+	workers           = flag.Int("workers", 4, "Maximum number of tasks executed concurrently")
+	regionWorkers     = flag.Int("region-workers", 0, "Maximum number of tasks executed concurrently in a region (0 for no limit)")
+	taskTimeout       = flag.Duration("task-timeout", 1*time.Hour, "Default maximum duration of a task execution")
+	metricsHostport   = flag.String("metrics-hostport", "", "Listening host:port for the Prometheus metrics (served on the discovery service when empty)")
+	policyFile        = flag.String("policy", "", "Access policy file binding callers to roles (no access control when empty)")
+	verifyAudit       = flag.Bool("verify-audit", false, "Verify the hash chain of the audit log and exit")
+	tlsCert           = flag.String("tls-cert", "", "Certificate file to serve the scheduler and discovery services over HTTPS")
+	tlsKey            = flag.String("tls-key", "", "Private key file of the TLS certificate")
+	tlsClientCA       = flag.String("tls-client-ca", "", "CA file verifying client certificates, required when set (mutual TLS)")
+	requireAuth       = flag.Bool("auth", true, "Require a bearer token on the scheduler service in HTTP mode")
+	issueAdminToken   = flag.String("issue-token", "", "Issue an admin token with the given name, print it and exit")
 	debug             = flag.Bool("debug", false, "print debug messages")
+
+	// tasks are dispatched when due, the flag is only kept for existing command lines
+	_ = flag.Duration("tick-frequency", 1*time.Minute, "Deprecated: ignored, tasks are executed as soon as they are due")
+
+	retryMaxAttempts = flag.Int("retry-max-attempts", 1, "Default number of execution attempts before a task is marked as failed")
+	retryBackoff     = flag.Duration("retry-backoff", 30*time.Second, "Default delay before retrying a failed task")
+	retryMultiplier  = flag.Float64("retry-multiplier", 2, "Default factor applied to the retry delay after each failed attempt")
+	retryJitter      = flag.Float64("retry-jitter", 0.2, "Default random variation of the retry delay, as a fraction of it")
+
+	misfirePolicy = flag.String("misfire-policy", model.MisfireWindow, "Default policy for tasks dispatched late: 'run' anyway, 'skip', or run within the misfire 'window'")
+	misfireWindow = flag.Duration("misfire-window", 1*time.Hour, "Default maximum lateness of a task run with the 'window' misfire policy")
 )
 
 var (
 	schedulerDir            = filepath.Join(os.Getenv("HOME"), ".awless-scheduler")
 	SOCK_ADDR               = filepath.Join(os.Getenv("HOME"), "awless-scheduler.sock")
 	minDurationBeforeRevert = 1 * time.Minute
-	stillExecutable         = -1 * time.Hour
+	misfireThreshold        = 1 * time.Minute
 	eventc                  = make(chan *event)
+	localTimeLayouts        = []string{"2006-01-02T15:04:05", "2006-01-02T15:04"}
 
-	taskStore         store
-	defaultCompileEnv = awsdriver.DefaultTemplateEnv()
-	driversFunc       = func(region string) (driver.Driver, error) { return awsservices.NewDriver(region, "") }
+	taskStore      store
+	compileEnvFunc = awsdriver.DefaultTemplateEnv
+	driversFunc    = func(region string) (driver.Driver, error) { return awsservices.NewDriver(region, "") }
 )
 
 func main() {
 	flag.Parse()
+	if _, err := parseMisfirePolicy(*misfirePolicy, *misfireWindow); err != nil {
+		log.Fatal(err)
+	}
+	rand.Seed(time.Now().UnixNano())
+
+	auditPath := filepath.Join(schedulerDir, "audit.log")
+	if *verifyAudit {
+		n, err := verifyAuditLog(auditPath)
+		if err != nil {
+			log.Fatalf("audit log %s tampered after %d valid entries: %s", auditPath, n, err)
+		}
+		log.Printf("audit log %s verified (%d entries)", auditPath, n)
+		return
+	}
 
+	if err := os.MkdirAll(schedulerDir, 0700); err != nil {
+		log.Fatal(err)
+	}
 	var err error
-	taskStore, err = NewFSStore(schedulerDir)
+	if tokens, err = openTokenStore(filepath.Join(schedulerDir, "tokens.json")); err != nil {
+		log.Fatal(err)
+	}
+	if *issueAdminToken != "" {
+		tk, err := tokens.issue(*issueAdminToken, true)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(tk.Secret)
+		return
+	}
+
+	if *policyFile != "" {
+		if accessPolicy, err = loadPolicy(*policyFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	taskStore, err = newStore(*storeBackend, schedulerDir)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Printf("Scheduler home dir: %s", schedulerDir)
+	defer taskStore.Close()
+	log.Printf("Scheduler home dir: %s (%s store)", schedulerDir, *storeBackend)
+	taskStore = &measuredStore{store: taskStore}
+
+	if auditor, err = openAuditLog(auditPath); err != nil {
+		log.Fatal(err)
+	}
+
+	if *webhookURLs != "" {
+		notifier = newWebhooks(strings.Split(*webhookURLs, ","), *webhookSecret, filepath.Join(schedulerDir, "webhooks.log"))
+		log.Printf("Starting webhooks notifier (%d subscribers)", len(notifier.urls))
+		go notifier.start()
+		defer notifier.stop()
+	}
 
 	log.Printf("Starting event collector")
 	go collectEvents()
 	defer close(eventc)
 
-	t := newTicker(taskStore, *tickerFrequency)
-	log.Printf("Starting ticker (frequency = %s)", t.frequency)
-	go t.start()
-	defer t.stop()
+	d, err := newDispatcher(taskStore, *workers, *regionWorkers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	taskStore = &dispatchedStore{store: taskStore, d: d}
+	log.Printf("Starting dispatcher (%d tasks queued, %d workers)", d.queueLen(), *workers)
+	go d.start()
+	defer d.stop()
 
+	handler := routes()
+	if *httpMode && *requireAuth {
+		handler = requireToken(handler)
+		if len(tokens.list()) == 0 {
+			log.Printf("Authentication required but no token issued: issue one with --issue-token, or start with --auth=false")
+		}
+	}
+	if !*httpMode {
+		uids, err := parseUIDs(*allowedUsers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		setAllowedUIDs(uids)
+		handler = identifyPeer(handler)
+	}
 	service, err := NewSchedulerService(
-		routes(),
+		handler,
 		*schedulerHostport,
 		*discoveryHostport,
 		*httpMode,
@@ -72,8 +172,28 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	service.authRequired = *httpMode && *requireAuth
+	if !*httpMode {
+		if err = service.setSocketPermissions(*sockMode, *sockGroup); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		if service.tlsConfig, err = serverTLSConfig(*tlsCert, *tlsKey, *tlsClientCA); err != nil {
+			log.Fatal(err)
+		}
+	} else if *tlsClientCA != "" {
+		log.Fatal("--tls-client-ca needs --tls-cert and --tls-key")
+	}
 	defer service.Close()
 
+	if *metricsHostport != "" {
+		go func() {
+			log.Printf("Starting metrics service on %s", *metricsHostport)
+			log.Fatal(http.ListenAndServe(*metricsHostport, http.HandlerFunc(serveMetrics)))
+		}()
+	}
+
 	go func() {
 		sigc := make(chan os.Signal, 1)
 		signal.Notify(sigc, os.Kill, os.Interrupt, syscall.SIGTERM)
@@ -88,7 +208,10 @@ type Service struct {
 	*http.Server
 	listener          *net.UnixListener
 	httpMode          bool
+	authRequired      bool
+	tlsConfig         *tls.Config
 	discoveryHostport string
+	discovery         *http.Server
 }
 
 func NewSchedulerService(handler http.Handler, serviceHostport, discoveryHostport string, httpMode bool) (*Service, error) {
@@ -97,27 +220,74 @@ func NewSchedulerService(handler http.Handler, serviceHostport, discoveryHostpor
 		Handler: handler,
 	}
 
-	service := &Service{Server: s, httpMode: httpMode, discoveryHostport: discoveryHostport}
+	service := &Service{Server: s, httpMode: httpMode, discoveryHostport: discoveryHostport, discovery: &http.Server{Addr: discoveryHostport}}
+	s.RegisterOnShutdown(streams.closeAll)
 
 	if !service.httpMode {
 		addr, err := net.ResolveUnixAddr("unix", SOCK_ADDR)
 		if err != nil {
 			return nil, err
 		}
-		l, err := net.ListenUnix("unix", addr)
+		l, err := listenUnix(addr)
 		if err != nil {
 			return nil, err
 		}
 		s.Addr = addr.String()
+		s.ConnContext = peerCredContext
 		service.listener = l
 	}
 
 	return service, nil
 }
 
+// setSocketPermissions sets the file mode, given in octal, and the group of the unix socket
+func (s *Service) setSocketPermissions(mode, group string) error {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid unix socket mode '%s'", mode)
+	}
+	if err = os.Chmod(s.Addr, os.FileMode(perm)); err != nil {
+		return err
+	}
+	if group == "" {
+		return nil
+	}
+
+	gid, err := strconv.Atoi(group)
+	if err != nil {
+		g, lookupErr := user.LookupGroup(group)
+		if lookupErr != nil {
+			return lookupErr
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("invalid gid of group %s: %s", group, g.Gid)
+		}
+	}
+	return os.Chown(s.Addr, -1, gid)
+}
+
+func parseUIDs(list string) (map[uint32]bool, error) {
+	if list == "" {
+		return nil, nil
+	}
+	uids := make(map[uint32]bool)
+	for _, field := range strings.Split(list, ",") {
+		uid, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid '%s' in allowed uids", field)
+		}
+		uids[uint32(uid)] = true
+	}
+	return uids, nil
+}
+
 func (s *Service) Start() error {
 	go s.startDiscoveryEnpoint()
 	log.Printf("Starting scheduler service on %s", s.addr())
+	if s.httpMode && s.tlsConfig != nil {
+		s.TLSConfig = s.tlsConfig
+		return s.ListenAndServeTLS("", "")
+	}
 	if s.httpMode {
 		return s.ListenAndServe()
 	}
@@ -126,13 +296,16 @@ func (s *Service) Start() error {
 
 func (s *Service) Close() error {
 	log.Print("Closing scheduler service")
+	if err := s.discovery.Shutdown(context.Background()); err != nil {
+		log.Printf("cannot close discovery service: %s", err)
+	}
 	return s.Shutdown(context.Background())
 }
 
 func (s *Service) addr() string {
 	if s.httpMode {
 		u := url.URL{Host: s.Addr}
-		u.Scheme = "http"
+		u.Scheme = s.scheme()
 		return u.String()
 	}
 	return s.Addr
@@ -140,19 +313,27 @@ func (s *Service) addr() string {
 
 func (s *Service) discoveryURL() string {
 	u := url.URL{Host: s.discoveryHostport}
-	u.Scheme = "http"
+	u.Scheme = s.scheme()
 	return u.String()
 }
 
+func (s *Service) scheme() string {
+	if s.tlsConfig != nil {
+		return "https"
+	}
+	return "http"
+}
+
 func (s *Service) startDiscoveryEnpoint() {
 	started := time.Now()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		v := model.ServiceInfo{
-			TickerFrequency: (*tickerFrequency).String(),
-			Uptime:          time.Since(started).String(),
-			ServiceAddr:     s.addr(),
-			UnixSockMode:    !s.httpMode,
+			Uptime:       time.Since(started).String(),
+			ServiceAddr:  s.addr(),
+			UnixSockMode: !s.httpMode,
+			AuthRequired: s.authRequired,
 		}
 		b, err := json.MarshalIndent(v, "", " ")
 		if err != nil {
@@ -161,9 +342,21 @@ func (s *Service) startDiscoveryEnpoint() {
 		}
 		w.Write(b)
 	})
+	if *metricsHostport == "" {
+		mux.HandleFunc("/metrics", serveMetrics)
+	}
 
+	s.discovery.Handler, s.discovery.TLSConfig = mux, s.tlsConfig
 	log.Printf("Starting HTTP discovery service on %s", s.discoveryURL())
-	log.Fatal(http.ListenAndServe(s.discoveryHostport, nil))
+	var err error
+	if s.tlsConfig != nil {
+		err = s.discovery.ListenAndServeTLS("", "")
+	} else {
+		err = s.discovery.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
 
 func routes() http.Handler {
@@ -173,7 +366,16 @@ func routes() http.Handler {
 		w.Write([]byte("scheduler up!"))
 	})
 	mux.HandleFunc("/tasks", tasks)
+	mux.HandleFunc("/tasks/", task)
 	mux.HandleFunc("/failures", listFailures)
+	mux.HandleFunc("/failures/", failure)
+	mux.HandleFunc("/cancelled", listCancelled)
+	mux.HandleFunc("/missed", listMissed)
+	mux.HandleFunc("/history", listHistory)
+	mux.HandleFunc("/events", streamEvents)
+	mux.HandleFunc("/audit", listAudit)
+	mux.HandleFunc("/tokens", tokensHandler)
+	mux.HandleFunc("/tokens/", tokenHandler)
 
 	return mux
 }
@@ -190,9 +392,422 @@ func tasks(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+func task(w http.ResponseWriter, r *http.Request) {
+	splits := strings.Split(strings.TrimPrefix(r.URL.Path, "/tasks/"), "/")
+	id := splits[0]
+	if id == "" || len(splits) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(splits) == 2 {
+		if splits[1] == "cancel" && r.Method == http.MethodPost {
+			cancelTask(w, r, id)
+			return
+		} else if splits[1] == "abort" && r.Method == http.MethodPost {
+			abortTask(w, r, id)
+			return
+		} else if splits[1] == "revert-now" && r.Method == http.MethodPost {
+			revertTaskNow(w, r, id)
+			return
+		} else if splits[1] == "runs" && r.Method == http.MethodGet {
+			listRuns(w, r, id)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		getTask(w, r, id)
+		return
+	} else if r.Method == http.MethodDelete {
+		deleteTask(w, r, id)
+		return
+	} else if r.Method == http.MethodPatch {
+		rescheduleTask(w, r, id)
+		return
+	}
+	http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+	return
+}
+
+func getTask(w http.ResponseWriter, r *http.Request, id string) {
+	tk, getErr := taskStore.Get(id)
+	if getErr != nil && getErr != errTaskNotFound {
+		log.Println(getErr)
+		http.Error(w, getErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	children, err := pendingChildren(id)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if getErr == errTaskNotFound {
+		tk, err = executedTask(id, children)
+	}
+	if err == errTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !authorized(w, r, verbRead, tk.Region, tk.Owner) {
+		return
+	}
+
+	for _, child := range children {
+		tk.Children = append(tk.Children, child.ID)
+	}
+
+	b, err := json.MarshalIndent(tk, "", " ")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// executedTask stands for a one-shot task removed from the store once executed,
+// as long as reverts of it are pending. Its reverts inherit its region and owner.
+func executedTask(id string, children []*model.Task) (*model.Task, error) {
+	if len(children) == 0 {
+		return nil, errTaskNotFound
+	}
+	tk := &model.Task{ID: id, Kind: model.KindRun, Region: children[0].Region, Owner: children[0].Owner}
+	runs, err := taskStore.GetRuns(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) > 0 {
+		tk.Content = runs[len(runs)-1].Template
+	}
+	return tk, nil
+}
+
+func deleteTask(w http.ResponseWriter, r *http.Request, id string) {
+	tk, err := taskStore.Get(id)
+	if err == errTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !authorized(w, r, verbDelete, tk.Region, tk.Owner) {
+		return
+	}
+
+	err = taskStore.Remove(id)
+	if err == errTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(r, model.AuditDelete, id, "")
+}
+
+func rescheduleTask(w http.ResponseWriter, r *http.Request, id string) {
+	tk, err := taskStore.Get(id)
+	if err == errTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !authorized(w, r, verbReschedule, tk.Region, tk.Owner) {
+		return
+	}
+
+	tz := r.FormValue("tz")
+	if tz == "" {
+		tz = tk.Timezone
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "invalid timezone for 'tz' param", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	runAt, err := getTimeParam(r.FormValue("run"), now, tk.RunAt, loc)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "invalid duration or time for 'run' param", http.StatusBadRequest)
+		return
+	}
+	revertAt, err := getTimeParam(r.FormValue("revert"), now, tk.RevertAt, loc)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "invalid duration or time for 'revert' param", http.StatusBadRequest)
+		return
+	}
+	if err = checkRevertTime(runAt, revertAt); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	tk.RunAt, tk.RevertAt = runAt, revertAt
+	tk.NextAttemptAt = time.Time{}
+	if err = taskStore.Update(tk); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(r, model.AuditReschedule, id, describeSchedule(tk))
+
+	b, err := json.MarshalIndent(tk, "", " ")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// cancelTask cancels a pending task, and its pending reverts with the 'reverts' param
+func cancelTask(w http.ResponseWriter, r *http.Request, id string) {
+	var withReverts bool
+	var err error
+	if param := r.FormValue("reverts"); param != "" {
+		if withReverts, err = strconv.ParseBool(param); err != nil {
+			http.Error(w, "invalid boolean for 'reverts' param", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tk, getErr := taskStore.Get(id)
+	if getErr != nil && getErr != errTaskNotFound {
+		log.Println(getErr)
+		http.Error(w, getErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	var children []*model.Task
+	if withReverts {
+		if children, err = pendingChildren(id); err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	// only the pending reverts are left to cancel once a one-shot task is executed
+	executed := getErr == errTaskNotFound
+	if executed {
+		tk, err = executedTask(id, children)
+	}
+	if err == errTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !authorized(w, r, verbCancel, tk.Region, tk.Owner) {
+		return
+	}
+	var reverts []*model.Task
+	for _, child := range children {
+		if child.Kind != model.KindRevert {
+			continue
+		}
+		// nothing is cancelled unless the whole chain can be
+		if !authorized(w, r, verbCancel, child.Region, child.Owner) {
+			return
+		}
+		reverts = append(reverts, child)
+	}
+
+	if !executed {
+		err = taskStore.MarkAsCancelled(id)
+		if err == errTaskNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(r, model.AuditCancel, id, "")
+	}
+
+	for _, revert := range reverts {
+		if err = taskStore.MarkAsCancelled(revert.ID); err == errTaskNotFound {
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit(r, model.AuditCancel, revert.ID, fmt.Sprintf("revert of task %s", id))
+	}
+}
+
+// abortTask interrupts a running task. The commands that succeeded are reverted
+// at the 'revert' param time, defaulting to the task revert time
+func abortTask(w http.ResponseWriter, r *http.Request, id string) {
+	tk, err := taskStore.Get(id)
+	if err == errTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !authorized(w, r, verbCancel, tk.Region, tk.Owner) {
+		return
+	}
+
+	loc, err := time.LoadLocation(tk.Timezone)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now().UTC()
+	revertAt, err := getTimeParam(r.FormValue("revert"), now, tk.RevertAt, loc)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "invalid duration or time for 'revert' param", http.StatusBadRequest)
+		return
+	}
+
+	if !abortExecution(id, revertAt) {
+		http.Error(w, fmt.Sprintf("task %s is not running", id), http.StatusConflict)
+		return
+	}
+	audit(r, model.AuditAbort, id, fmt.Sprintf("revert=%s", revertAt.Format(time.RFC3339)))
+}
+
+// revertTaskNow runs the pending reverts of a task now. Without pending revert,
+// a revert task is created from the last recorded revertible execution
+func revertTaskNow(w http.ResponseWriter, r *http.Request, id string) {
+	children, err := pendingChildren(id)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	reverts := make([]*model.Task, 0)
+	for _, child := range children {
+		if child.Kind != model.KindRevert {
+			continue
+		}
+		// all reverts are authorized before any runs now
+		if !authorized(w, r, verbRevert, child.Region, child.Owner) {
+			return
+		}
+		reverts = append(reverts, child)
+	}
+
+	now := time.Now().UTC()
+	for _, revert := range reverts {
+		revert.RunAt, revert.NextAttemptAt = now, time.Time{}
+		if err = taskStore.Update(revert); err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if len(reverts) == 0 {
+		runs, err := taskStore.GetRuns(id)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(runs) > 0 && !authorized(w, r, verbRevert, runs[len(runs)-1].Region, runs[len(runs)-1].Owner) {
+			return
+		}
+		revert, status, err := createRevertFromHistory(id, now)
+		if err != nil {
+			if status == http.StatusInternalServerError {
+				log.Println(err)
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		reverts = append(reverts, revert)
+	}
+	for _, revert := range reverts {
+		audit(r, model.AuditRevertNow, id, fmt.Sprintf("revert task %s", revert.ID))
+	}
+
+	b, err := marshalTasks(reverts)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// createRevertFromHistory creates a revert task for the last revertible execution of a task.
+// The revert task id derives from the execution, so that an execution is reverted only once
+func createRevertFromHistory(id string, runAt time.Time) (*model.Task, int, error) {
+	runs, err := taskStore.GetRuns(id)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	var last *model.Run
+	var revertTemplate string
+	for _, run := range runs {
+		if tpl := runRevertTemplate(run); tpl != "" {
+			last, revertTemplate = run, tpl
+		}
+	}
+	if last == nil {
+		return nil, http.StatusNotFound, fmt.Errorf("no revertible execution of task %s", id)
+	}
+	if last.RevertTaskID != "" {
+		return nil, http.StatusConflict, fmt.Errorf("last execution of task %s already reverted by task %s", id, last.RevertTaskID)
+	}
+
+	revertID := fmt.Sprintf("%s-revert-%d", id, last.StartedAt.UnixNano())
+	if reverted, err := taskStore.GetRuns(revertID); err != nil {
+		return nil, http.StatusInternalServerError, err
+	} else if len(reverted) > 0 {
+		return nil, http.StatusConflict, fmt.Errorf("last execution of task %s already reverted by task %s", id, revertID)
+	}
+
+	revert := &model.Task{ID: revertID, RunAt: runAt, Region: last.Region, Content: revertTemplate, Kind: model.KindRevert, ParentID: id, Owner: last.Owner}
+	if err = taskStore.Create(revert); err != nil {
+		if _, getErr := taskStore.Get(revertID); getErr == nil {
+			return nil, http.StatusConflict, fmt.Errorf("last execution of task %s already reverted by task %s", id, revertID)
+		}
+		return nil, http.StatusInternalServerError, err
+	}
+	notifyTask(model.EventCreated, revert, nil)
+	return revert, http.StatusOK, nil
+}
+
 func listTasks(w http.ResponseWriter, r *http.Request) {
 	tasks, err := taskStore.GetTasks()
-	b, err := marshalTasks(tasks)
+	b, err := marshalTasks(readableTasks(r, tasks))
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -204,7 +819,165 @@ func listTasks(w http.ResponseWriter, r *http.Request) {
 
 func listFailures(w http.ResponseWriter, r *http.Request) {
 	tasks, err := taskStore.GetFailures()
-	b, err := marshalTasks(tasks)
+	b, err := marshalTasks(readableTasks(r, tasks))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func failure(w http.ResponseWriter, r *http.Request) {
+	splits := strings.Split(strings.TrimPrefix(r.URL.Path, "/failures/"), "/")
+	id := splits[0]
+	if id == "" || len(splits) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(splits) == 2 {
+		if splits[1] == "retry" && r.Method == http.MethodPost {
+			retryFailure(w, r, id)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		deleteFailure(w, r, id)
+		return
+	}
+	http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+	return
+}
+
+func retryFailure(w http.ResponseWriter, r *http.Request, id string) {
+	tk, err := taskStore.GetFailure(id)
+	if err == errTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !authorized(w, r, verbRetry, tk.Region, tk.Owner) {
+		return
+	}
+
+	tz := r.FormValue("tz")
+	if tz == "" {
+		tz = tk.Timezone
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "invalid timezone for 'tz' param", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	runAt, err := getTimeParam(r.FormValue("run"), now, now, loc)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "invalid duration or time for 'run' param", http.StatusBadRequest)
+		return
+	}
+	// without 'revert' param, the task keeps its delay before revert
+	revertAt := tk.RevertAt
+	if !revertAt.IsZero() {
+		revertAt = runAt.Add(tk.RevertAt.Sub(tk.RunAt))
+	}
+	if revertAt, err = getTimeParam(r.FormValue("revert"), now, revertAt, loc); err != nil {
+		log.Println(err)
+		http.Error(w, "invalid duration or time for 'revert' param", http.StatusBadRequest)
+		return
+	}
+	if err = checkRevertTime(runAt, revertAt); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	tk.RunAt, tk.RevertAt = runAt, revertAt
+	tk.Attempts, tk.NextAttemptAt, tk.Failure = 0, time.Time{}, nil
+	if err = taskStore.Requeue(tk); err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(r, model.AuditRetry, id, describeSchedule(tk))
+
+	b, err := json.MarshalIndent(tk, "", " ")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func deleteFailure(w http.ResponseWriter, r *http.Request, id string) {
+	tk, err := taskStore.GetFailure(id)
+	if err == errTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !authorized(w, r, verbDelete, tk.Region, tk.Owner) {
+		return
+	}
+
+	err = taskStore.RemoveFailure(id)
+	if err == errTaskNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(r, model.AuditDeleteFailure, id, "")
+}
+
+func listMissed(w http.ResponseWriter, r *http.Request) {
+	tasks, err := taskStore.GetMissed()
+	b, err := marshalTasks(readableTasks(r, tasks))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func listCancelled(w http.ResponseWriter, r *http.Request) {
+	tasks, err := taskStore.GetCancelled()
+	b, err := marshalTasks(readableTasks(r, tasks))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func listRuns(w http.ResponseWriter, r *http.Request, id string) {
+	runs, err := taskStore.GetRuns(id)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.MarshalIndent(readableRuns(r, runs), "", " ")
 	if err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -213,6 +986,57 @@ func listFailures(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+func listHistory(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	from, err := getTimeParam(r.FormValue("from"), now, time.Time{}, time.UTC)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "invalid duration or time for 'from' param", http.StatusBadRequest)
+		return
+	}
+	to, err := getTimeParam(r.FormValue("to"), now, time.Time{}, time.UTC)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "invalid duration or time for 'to' param", http.StatusBadRequest)
+		return
+	}
+
+	runs, err := taskStore.GetHistory(from, to)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.MarshalIndent(readableRuns(r, runs), "", " ")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+func readableTasks(r *http.Request, tasks []*model.Task) []*model.Task {
+	readables := make([]*model.Task, 0, len(tasks))
+	for _, tk := range tasks {
+		if readable(r, tk.Region, tk.Owner) {
+			readables = append(readables, tk)
+		}
+	}
+	return readables
+}
+
+func readableRuns(r *http.Request, runs []*model.Run) []*model.Run {
+	readables := make([]*model.Run, 0, len(runs))
+	for _, run := range runs {
+		if readable(r, run.Region, run.Owner) {
+			readables = append(readables, run)
+		}
+	}
+	return readables
+}
+
 func marshalTasks(tasks []*model.Task) ([]byte, error) {
 	sort.Slice(tasks, func(i int, j int) bool { return !tasks[i].RunAt.Before(tasks[j].RunAt) })
 
@@ -234,25 +1058,84 @@ func createTask(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "missing region", http.StatusBadRequest)
 		return
 	}
-	runAt, err := getTimeParam(r.FormValue("run"), time.Now().UTC())
+	owner := requestCaller(r)
+	if !authorized(w, r, verbCreate, region, owner) {
+		return
+	}
+	tz := r.FormValue("tz")
+	loc, err := time.LoadLocation(tz)
 	if err != nil {
 		log.Println(err)
-		http.Error(w, "invalid duration for 'run' param", http.StatusBadRequest)
+		http.Error(w, "invalid timezone for 'tz' param", http.StatusBadRequest)
 		return
 	}
-	revertAt, err := getTimeParam(r.FormValue("revert"), time.Time{})
+	now := time.Now().UTC()
+	runAt, err := getTimeParam(r.FormValue("run"), now, now, loc)
 	if err != nil {
 		log.Println(err)
-		http.Error(w, "invalid duration for 'revert' param", http.StatusBadRequest)
+		http.Error(w, "invalid duration or time for 'run' param", http.StatusBadRequest)
 		return
 	}
-	if !revertAt.IsZero() && revertAt.Sub(runAt).Seconds() < minDurationBeforeRevert.Seconds() {
-		err = fmt.Errorf("revert time is less that %s before run time", minDurationBeforeRevert)
+	revertFrom := now
+	cronExpr := r.FormValue("cron")
+	if cronExpr != "" {
+		if r.FormValue("run") != "" {
+			log.Println("both 'run' and 'cron' params given")
+			http.Error(w, "'run' and 'cron' params are mutually exclusive", http.StatusBadRequest)
+			return
+		}
+		if runAt, err = nextCronRun(cronExpr, loc, now); err != nil {
+			log.Println(err)
+			http.Error(w, fmt.Sprintf("invalid expression for 'cron' param: %s", err), http.StatusBadRequest)
+			return
+		}
+		// a recurring task is reverted relatively to each of its runs
+		revertFrom = runAt
+	}
+	revertAt, err := getTimeParam(r.FormValue("revert"), revertFrom, time.Time{}, loc)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "invalid duration or time for 'revert' param", http.StatusBadRequest)
+		return
+	}
+	if err = checkRevertTime(runAt, revertAt); err != nil {
 		log.Println(err)
 		http.Error(w, err.Error(), http.StatusNotAcceptable)
 		return
 	}
 
+	retry, err := getRetryPolicy(r)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	misfire, err := getMisfirePolicy(r)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var timeout time.Duration
+	if param := r.FormValue("timeout"); param != "" {
+		if timeout, err = time.ParseDuration(param); err != nil || timeout <= 0 {
+			log.Println(err)
+			http.Error(w, "invalid positive duration for 'timeout' param", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var rollbackOnFailure bool
+	if param := r.FormValue("rollback-on-failure"); param != "" {
+		if rollbackOnFailure, err = strconv.ParseBool(param); err != nil {
+			log.Println(err)
+			http.Error(w, "invalid boolean for 'rollback-on-failure' param", http.StatusBadRequest)
+			return
+		}
+	}
+
 	tplTxt, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Println(err)
@@ -295,23 +1178,132 @@ func createTask(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tk := &model.Task{Content: string(tplTxt), RunAt: runAt, RevertAt: revertAt, Region: region}
+	tk := &model.Task{Content: string(tplTxt), RunAt: runAt, RevertAt: revertAt, Region: region, Cron: cronExpr, Timezone: tz, Kind: model.KindRun, Owner: owner, Retry: retry, Misfire: misfire, Timeout: timeout, RollbackOnFailure: rollbackOnFailure}
 
 	if err := taskStore.Create(tk); err != nil {
 		log.Println(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	notifyTask(model.EventCreated, tk, nil)
+	audit(r, model.AuditCreate, tk.ID, describeSchedule(tk))
+
+	b, err := json.MarshalIndent(tk, "", " ")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
 }
 
-func getTimeParam(param string, defaultTime time.Time) (time.Time, error) {
+// getRetryPolicy reads the retry params, defaulting to the server flags
+func getRetryPolicy(r *http.Request) (model.RetryPolicy, error) {
+	policy := model.RetryPolicy{MaxAttempts: *retryMaxAttempts, InitialBackoff: *retryBackoff, Multiplier: *retryMultiplier, Jitter: *retryJitter}
+
+	if param := r.FormValue("retry-max-attempts"); param != "" {
+		attempts, err := strconv.Atoi(param)
+		if err != nil || attempts < 1 {
+			return policy, fmt.Errorf("invalid positive integer for 'retry-max-attempts' param")
+		}
+		policy.MaxAttempts = attempts
+	}
+	if param := r.FormValue("retry-backoff"); param != "" {
+		backoff, err := time.ParseDuration(param)
+		if err != nil || backoff <= 0 {
+			return policy, fmt.Errorf("invalid positive duration for 'retry-backoff' param")
+		}
+		policy.InitialBackoff = backoff
+	}
+	if param := r.FormValue("retry-multiplier"); param != "" {
+		multiplier, err := strconv.ParseFloat(param, 64)
+		if err != nil || multiplier < 1 {
+			return policy, fmt.Errorf("invalid number greater or equal to 1 for 'retry-multiplier' param")
+		}
+		policy.Multiplier = multiplier
+	}
+	if param := r.FormValue("retry-jitter"); param != "" {
+		jitter, err := strconv.ParseFloat(param, 64)
+		if err != nil || jitter < 0 || jitter > 1 {
+			return policy, fmt.Errorf("invalid number between 0 and 1 for 'retry-jitter' param")
+		}
+		policy.Jitter = jitter
+	}
+
+	return policy, nil
+}
+
+// describeSchedule summarizes the region and run times of a task for the audit log
+func describeSchedule(tk *model.Task) string {
+	desc := fmt.Sprintf("region=%s run=%s", tk.Region, tk.RunAt.Format(time.RFC3339))
+	if !tk.RevertAt.IsZero() {
+		desc += fmt.Sprintf(" revert=%s", tk.RevertAt.Format(time.RFC3339))
+	}
+	if tk.Cron != "" {
+		desc += fmt.Sprintf(" cron=%q", tk.Cron)
+	}
+	return desc
+}
+
+func checkRevertTime(runAt, revertAt time.Time) error {
+	if !revertAt.IsZero() && revertAt.Sub(runAt).Seconds() < minDurationBeforeRevert.Seconds() {
+		return fmt.Errorf("revert time is less that %s before run time", minDurationBeforeRevert)
+	}
+	return nil
+}
+
+// getTimeParam accepts a duration relative to 'from', an RFC3339 time,
+// or a date and time without offset that is then interpreted in 'loc'
+func getTimeParam(param string, from, defaultTime time.Time, loc *time.Location) (time.Time, error) {
 	if param == "" {
 		return defaultTime, nil
 	}
 
-	dur, err := time.ParseDuration(param)
-	if err != nil {
-		return time.Time{}, err
+	if dur, err := time.ParseDuration(param); err == nil {
+		return from.Add(dur), nil
+	}
+	if t, err := time.Parse(time.RFC3339, param); err == nil {
+		return t.UTC(), nil
 	}
-	return time.Now().UTC().Add(dur), nil
+	for _, layout := range localTimeLayouts {
+		if t, err := time.ParseInLocation(layout, param, loc); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("'%s' is neither a duration nor a time", param)
+}
+
+// getMisfirePolicy reads the misfire params, defaulting to the server flags
+func getMisfirePolicy(r *http.Request) (model.MisfirePolicy, error) {
+	action, window := *misfirePolicy, *misfireWindow
+
+	if param := r.FormValue("misfire"); param != "" {
+		action = param
+	}
+	if param := r.FormValue("misfire-window"); param != "" {
+		var err error
+		if window, err = time.ParseDuration(param); err != nil {
+			return model.MisfirePolicy{}, fmt.Errorf("invalid duration for 'misfire-window' param")
+		}
+	}
+
+	return parseMisfirePolicy(action, window)
+}
+
+func parseMisfirePolicy(action string, window time.Duration) (model.MisfirePolicy, error) {
+	switch action {
+	case model.MisfireRun, model.MisfireSkip:
+		return model.MisfirePolicy{Action: action}, nil
+	case model.MisfireWindow:
+		if window <= 0 {
+			return model.MisfirePolicy{}, fmt.Errorf("invalid misfire window %s: expecting a positive duration", window)
+		}
+		return model.MisfirePolicy{Action: action, Window: window}, nil
+	default:
+		return model.MisfirePolicy{}, fmt.Errorf("invalid misfire policy '%s': expecting 'run', 'skip' or 'window'", action)
+	}
+}
+
+func defaultMisfirePolicy() model.MisfirePolicy {
+	return model.MisfirePolicy{Action: *misfirePolicy, Window: *misfireWindow}
 }
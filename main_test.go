@@ -1,19 +1,93 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"time"
 
 	"github.com/wallix/awless-scheduler/client"
+	"github.com/wallix/awless-scheduler/model"
 	"github.com/wallix/awless/template"
 	"github.com/wallix/awless/template/driver"
 )
 
-func TestTasksAPI(t *testing.T) {
-	taskStore = createTmpFSStore()
+func TestGetTimeParam(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	tcases := []struct {
+		param string
+		want  time.Time
+	}{
+		{param: "", want: from},
+		{param: "2h", want: from.Add(2 * time.Hour)},
+		{param: "2026-11-02T08:00:00+01:00", want: time.Date(2026, 11, 2, 7, 0, 0, 0, time.UTC)},
+		{param: "2026-11-02T08:00", want: time.Date(2026, 11, 2, 7, 0, 0, 0, time.UTC)},
+		{param: "2026-10-02T08:00:00", want: time.Date(2026, 10, 2, 6, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tcase := range tcases {
+		got, err := getTimeParam(tcase.param, from, from, paris)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(tcase.want) {
+			t.Fatalf("%q: got %s, want %s", tcase.param, got, tcase.want)
+		}
+	}
+
+	if _, err := getTimeParam("tomorrow", from, from, paris); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestCloseEndsEventStreams(t *testing.T) {
+	taskStore = createTmpStore("fs")
 	defer taskStore.Destroy()
 
+	service, err := NewSchedulerService(routes(), "127.0.0.1:9098", "127.0.0.1:9099", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go service.Start()
+	time.Sleep(1 * time.Second)
+
+	cli, err := client.New(service.discoveryURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := cli.Watch(context.Background(), client.WatchFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- service.Close() }()
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("service not closed while streaming events")
+	}
+	for range events {
+	}
+	if _, err = client.New(service.discoveryURL()); err == nil {
+		t.Fatal("expected discovery service to be closed")
+	}
+}
+
+func TestTasksAPI(t *testing.T) {
 	service, err := NewSchedulerService(routes(), "127.0.0.1:9090", "127.0.0.1:9091", true)
 	if err != nil {
 		t.Fatal(err)
@@ -32,145 +106,1160 @@ func TestTasksAPI(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	postTemplate := func(t *testing.T, txt string) {
-		if err := schedClient.Post(client.Form{
+	postTemplate := func(t *testing.T, txt string) *model.Task {
+		tk, err := schedClient.PostTask(client.Form{
 			Region:   "us-west-1",
 			RunIn:    "2m",
 			RevertIn: "2h",
 			Template: txt,
-		}); err != nil {
+		})
+		if err != nil {
 			t.Fatal(err)
 		}
+		return tk
 	}
 
 	tplText := "create user name=toto\ncreate user name=tata"
 
-	t.Run("ping service", func(t *testing.T) {
-		if err := schedClient.Ping(); err != nil {
-			t.Fatal(err)
-		}
-	})
+	for _, backend := range storeBackends {
+		taskStore = createTmpStore(backend)
 
-	t.Run("template successfully received", func(t *testing.T) {
-		defer taskStore.Cleanup()
+		t.Run(backend, func(t *testing.T) {
+			defer taskStore.Destroy()
 
-		postTemplate(t, tplText)
+			t.Run("ping service", func(t *testing.T) {
+				if err := schedClient.Ping(); err != nil {
+					t.Fatal(err)
+				}
+			})
 
-		tasks, err := schedClient.ListTasks()
-		if err != nil {
-			t.Fatal(err)
-		}
+			t.Run("template successfully received", func(t *testing.T) {
+				defer taskStore.Cleanup()
 
-		if got, want := len(tasks), 1; got != want {
-			t.Fatalf("got %d, want %d", got, want)
-		}
-		if got, want := tasks[0].Content, tplText; got != want {
-			t.Fatalf("got \n%q\nwant\n%q\n", got, want)
-		}
-	})
+				postTemplate(t, tplText)
 
-	t.Run("listing templates", func(t *testing.T) {
-		defer taskStore.Cleanup()
+				tasks, err := schedClient.ListTasks()
+				if err != nil {
+					t.Fatal(err)
+				}
 
-		postTemplate(t, tplText)
+				if got, want := len(tasks), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := tasks[0].Content, tplText; got != want {
+					t.Fatalf("got \n%q\nwant\n%q\n", got, want)
+				}
+			})
 
-		tasks, err := schedClient.ListTasks()
-		if err != nil {
-			t.Fatal(err)
-		}
+			t.Run("listing templates", func(t *testing.T) {
+				defer taskStore.Cleanup()
 
-		if got, want := len(tasks), 1; got != want {
-			t.Fatalf("got %d, want %d", got, want)
-		}
-		if got, want := string(tasks[0].Content), tplText; got != want {
-			t.Fatalf("got %s, want %s", got, want)
-		}
-		if got, want := string(tasks[0].Region), "us-west-1"; got != want {
-			t.Fatalf("got %s, want %s", got, want)
-		}
-	})
+				postTemplate(t, tplText)
 
-	t.Run("executing task", func(t *testing.T) {
-		defer taskStore.Cleanup()
+				tasks, err := schedClient.ListTasks()
+				if err != nil {
+					t.Fatal(err)
+				}
 
-		postTemplate(t, tplText)
+				if got, want := len(tasks), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := string(tasks[0].Content), tplText; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				if got, want := string(tasks[0].Region), "us-west-1"; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+			})
 
-		tasks, err := schedClient.ListTasks()
-		if err != nil {
-			t.Fatal(err)
-		}
-		if got, want := len(tasks), 1; got != want {
-			t.Fatalf("got %d, want %d", got, want)
-		}
+			t.Run("identical templates get distinct ids", func(t *testing.T) {
+				defer taskStore.Cleanup()
 
-		task := tasks[0]
+				first := postTemplate(t, tplText)
+				second := postTemplate(t, tplText)
 
-		env := newTemplateEnv(func(key string) (template.Definition, bool) {
-			return template.Definition{ExtraParams: []string{"name", "user"}}, true
-		})
+				if first.ID == "" || second.ID == "" {
+					t.Fatalf("expected ids, got %q and %q", first.ID, second.ID)
+				}
+				if first.ID == second.ID {
+					t.Fatalf("expected distinct ids, got %s twice", first.ID)
+				}
 
-		if _, err = executeTask(task, &happyDriver{}, env); err != nil {
-			t.Fatal(err)
-		}
+				tasks, err := schedClient.ListTasks()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(tasks), 2; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+			})
 
-		tasks, err = schedClient.ListTasks()
-		if err != nil {
-			t.Fatal(err)
-		}
+			t.Run("get and delete task by id", func(t *testing.T) {
+				defer taskStore.Cleanup()
 
-		if got, want := len(tasks), 1; got != want {
-			t.Fatalf("got %d, want %d", got, want)
-		}
+				posted := postTemplate(t, tplText)
 
-		revertTplText := "delete user name=tata\ndelete user name=toto"
-		if got, want := tasks[0].Content, revertTplText; got != want {
-			t.Fatalf("got \n%q\nwant\n%q\n", got, want)
-		}
-	})
+				tk, err := schedClient.GetTask(posted.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := tk.ID, posted.ID; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				if got, want := tk.Content, tplText; got != want {
+					t.Fatalf("got \n%q\nwant\n%q\n", got, want)
+				}
 
-	t.Run("fail executing driver", func(t *testing.T) {
-		defer taskStore.Cleanup()
+				if err = schedClient.DeleteTask(posted.ID); err != nil {
+					t.Fatal(err)
+				}
+				if _, err = schedClient.GetTask(posted.ID); err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				if err = schedClient.DeleteTask(posted.ID); err == nil {
+					t.Fatal("expected error, got nil")
+				}
+			})
 
-		postTemplate(t, tplText)
+			t.Run("reschedule task", func(t *testing.T) {
+				defer taskStore.Cleanup()
 
-		tasks, err := schedClient.ListTasks()
-		if err != nil {
-			t.Fatal(err)
-		}
+				posted := postTemplate(t, tplText)
 
-		if got, want := len(tasks), 1; got != want {
-			t.Fatalf("got %d, want %d", got, want)
-		}
+				tk, err := schedClient.Reschedule(posted.ID, client.RescheduleForm{RunIn: "1h", RevertIn: "3h"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := tk.ID, posted.ID; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				if !tk.RunAt.After(posted.RunAt) {
+					t.Fatalf("expected run time %s to be after %s", tk.RunAt, posted.RunAt)
+				}
+				if !tk.RevertAt.After(posted.RevertAt) {
+					t.Fatalf("expected revert time %s to be after %s", tk.RevertAt, posted.RevertAt)
+				}
 
-		task := tasks[0]
+				if _, err = schedClient.Reschedule(posted.ID, client.RescheduleForm{RunIn: "4h"}); err == nil {
+					t.Fatal("expected error when revert comes before run, got nil")
+				}
 
-		env := newTemplateEnv(func(key string) (template.Definition, bool) {
-			return template.Definition{RequiredParams: []string{"name", "user"}}, true
-		})
-		if _, err := executeTask(task, &failDriver{}, env); err == nil {
-			t.Fatal("expected error, got nil")
-		}
+				tasks, err := schedClient.ListTasks()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(tasks), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := tasks[0].RunAt, tk.RunAt; !got.Equal(want) {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+			})
 
-		tasks, err = schedClient.ListTasks()
-		if err != nil {
-			t.Fatal(err)
-		}
+			t.Run("cancel task", func(t *testing.T) {
+				defer taskStore.Cleanup()
 
-		if got, want := len(tasks), 0; got != want {
-			t.Fatalf("got %d, want %d", got, want)
-		}
+				posted := postTemplate(t, tplText)
 
-		fails, err := schedClient.ListFailures()
-		if err != nil {
-			t.Fatal(err)
-		}
+				if err := schedClient.Cancel(posted.ID); err != nil {
+					t.Fatal(err)
+				}
 
-		if got, want := len(fails), 1; got != want {
-			t.Fatalf("got %d, want %d", got, want)
-		}
+				tasks, err := schedClient.ListTasks()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(tasks), 0; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
 
-		if got, want := fails[0].Content, tplText; got != want {
-			t.Fatalf("got \n%q\nwant\n%q\n", got, want)
-		}
-	})
+				cancelled, err := schedClient.ListCancelled()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(cancelled), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := cancelled[0].ID, posted.ID; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				if err := schedClient.Cancel(posted.ID); err == nil {
+					t.Fatal("expected error, got nil")
+				}
+			})
+
+			t.Run("executing task", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				postTemplate(t, tplText)
+
+				tasks, err := schedClient.ListTasks()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(tasks), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+
+				task := tasks[0]
+
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{ExtraParams: []string{"name", "user"}}, true
+				})
+
+				if _, err = executeTask(task, &happyDriver{}, env); err != nil {
+					t.Fatal(err)
+				}
+
+				tasks, err = schedClient.ListTasks()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got, want := len(tasks), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+
+				revertTplText := "delete user name=tata\ndelete user name=toto"
+				if got, want := tasks[0].Content, revertTplText; got != want {
+					t.Fatalf("got \n%q\nwant\n%q\n", got, want)
+				}
+			})
+
+			t.Run("absolute times in timezone", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				runAt := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+				posted, err := schedClient.PostTask(client.Form{
+					Region:   "us-west-1",
+					RunAt:    runAt,
+					RevertIn: "30h",
+					Template: tplText,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := posted.RunAt, runAt.UTC(); !got.Equal(want) {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				tk, err := schedClient.Reschedule(posted.ID, client.RescheduleForm{RunAt: runAt.Add(time.Hour)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := tk.RunAt, runAt.Add(time.Hour).UTC(); !got.Equal(want) {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				if _, err = schedClient.PostTask(client.Form{Region: "us-west-1", Timezone: "Mars/Olympus", Template: tplText}); err == nil {
+					t.Fatal("expected error for unknown timezone, got nil")
+				}
+
+				posted, err = schedClient.PostTask(client.Form{Region: "us-west-1", Cron: "0 8 * * *", Timezone: "Europe/Paris", Template: tplText})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := posted.Timezone, "Europe/Paris"; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				paris, _ := time.LoadLocation("Europe/Paris")
+				if got, want := posted.RunAt.In(paris).Hour(), 8; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+			})
+
+			t.Run("recurring task is rearmed after execution", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				if _, err := schedClient.PostTask(client.Form{Region: "us-west-1", RunIn: "2m", Cron: "@hourly", Template: tplText}); err == nil {
+					t.Fatal("expected error when both run and cron given, got nil")
+				}
+				if _, err := schedClient.PostTask(client.Form{Region: "us-west-1", Cron: "61 * * * *", Template: tplText}); err == nil {
+					t.Fatal("expected error for invalid cron, got nil")
+				}
+
+				before := time.Now().UTC()
+				posted, err := schedClient.PostTask(client.Form{Region: "us-west-1", Cron: "@hourly", RevertIn: "30m", Template: tplText})
+				if err != nil {
+					t.Fatal(err)
+				}
+				after := time.Now().UTC()
+				// the post may cross an hour boundary
+				if got := posted.RunAt; !got.Equal(before.Truncate(time.Hour).Add(time.Hour)) && !got.Equal(after.Truncate(time.Hour).Add(time.Hour)) {
+					t.Fatalf("got %s, want next hour after %s", got, before)
+				}
+				if got, want := posted.RevertAt, posted.RunAt.Add(30*time.Minute); !got.Equal(want) {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				firstRun := posted.RunAt
+
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{ExtraParams: []string{"name", "user"}}, true
+				})
+				if _, err = executeTask(posted, &happyDriver{}, env); err != nil {
+					t.Fatal(err)
+				}
+
+				rearmed, err := schedClient.GetTask(posted.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := rearmed.Cron, "@hourly"; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				if got, want := rearmed.RunAt, firstRun.Add(time.Hour); !got.Equal(want) {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				if got, want := rearmed.RevertAt, rearmed.RunAt.Add(30*time.Minute); !got.Equal(want) {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				tasks, err := schedClient.ListTasks()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(tasks), 2; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+
+				// a failed run rearms the task too, only one-shot tasks being moved to the failures
+				failing, err := schedClient.PostTask(client.Form{Region: "us-west-1", Cron: "@hourly", Template: tplText})
+				if err != nil {
+					t.Fatal(err)
+				}
+				failingRun := failing.RunAt
+				if _, err = executeTask(failing, &failDriver{}, env); err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				failed, err := schedClient.GetTask(failing.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := failed.RunAt, failingRun.Add(time.Hour); !got.Equal(want) {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				if failed.Failure == nil || failed.Attempts != 0 {
+					t.Fatalf("got failure %#v after %d attempts, want failure kept and attempts reset", failed.Failure, failed.Attempts)
+				}
+				failures, err := schedClient.ListFailures()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(failures), 0; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+			})
+
+			t.Run("revert tasks are linked to their parent", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				posted, err := schedClient.PostTask(client.Form{Region: "us-west-1", Cron: "@hourly", RevertIn: "30m", Template: tplText})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := posted.Kind, model.KindRun; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{ExtraParams: []string{"name", "user"}}, true
+				})
+				if _, err = executeTask(posted, &happyDriver{}, env); err != nil {
+					t.Fatal(err)
+				}
+
+				parent, err := schedClient.GetTask(posted.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(parent.Children), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				revert, err := schedClient.GetTask(parent.Children[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := revert.Kind, model.KindRevert; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				if got, want := revert.ParentID, posted.ID; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				other := postTemplate(t, tplText)
+				if err = schedClient.CancelWithReverts(parent.ID); err != nil {
+					t.Fatal(err)
+				}
+				tasks, err := schedClient.ListTasks()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(tasks), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := tasks[0].ID, other.ID; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				cancelled, err := schedClient.ListCancelled()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(cancelled), 2; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+			})
+
+			t.Run("reverts of executed one-shot task", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				posted, err := schedClient.PostTask(client.Form{Region: "us-west-1", RunIn: "2m", RevertIn: "30m", Template: tplText})
+				if err != nil {
+					t.Fatal(err)
+				}
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{ExtraParams: []string{"name", "user"}}, true
+				})
+				if _, err = executeTask(posted, &happyDriver{}, env); err != nil {
+					t.Fatal(err)
+				}
+
+				parent, err := schedClient.GetTask(posted.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(parent.Children), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := parent.Region, "us-west-1"; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				if err = schedClient.CancelWithReverts(posted.ID); err != nil {
+					t.Fatal(err)
+				}
+				tasks, err := schedClient.ListTasks()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(tasks), 0; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				cancelled, err := schedClient.ListCancelled()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(cancelled), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := cancelled[0].ID, parent.Children[0]; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				if _, err = schedClient.GetTask(posted.ID); err == nil {
+					t.Fatal("expected error once reverts are cancelled, got nil")
+				}
+			})
+
+			t.Run("revert now", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{ExtraParams: []string{"name", "user"}}, true
+				})
+
+				scheduled := postTemplate(t, tplText)
+				if _, err := executeTask(scheduled, &happyDriver{}, env); err != nil {
+					t.Fatal(err)
+				}
+				reverts, err := schedClient.RevertNow(scheduled.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(reverts), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := reverts[0].ParentID, scheduled.ID; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				if delay := time.Since(reverts[0].RunAt); delay < 0 || delay > time.Minute {
+					t.Fatalf("got revert run at %s, want now", reverts[0].RunAt)
+				}
+
+				if _, err = schedClient.RevertNow("unknown"); err == nil {
+					t.Fatal("expected error for unknown task, got nil")
+				}
+
+				unscheduled, err := schedClient.PostTask(client.Form{Region: "us-west-1", RunIn: "2m", Template: tplText})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err = executeTask(unscheduled, &happyDriver{}, env); err != nil {
+					t.Fatal(err)
+				}
+				reverts, err = schedClient.RevertNow(unscheduled.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(reverts), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := reverts[0].Content, "delete user name=tata\ndelete user name=toto"; got != want {
+					t.Fatalf("got %q, want %q", got, want)
+				}
+				if got, want := reverts[0].Kind, model.KindRevert; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				again, err := schedClient.RevertNow(unscheduled.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := again[0].ID, reverts[0].ID; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				if _, err = executeTask(reverts[0], &happyDriver{}, env); err != nil {
+					t.Fatal(err)
+				}
+				if _, err = schedClient.RevertNow(unscheduled.ID); err == nil {
+					t.Fatal("expected error for execution already reverted, got nil")
+				}
+
+				// history recorded before revert templates is reverted from the executed template
+				now := time.Now().UTC()
+				if err = taskStore.AddRun(&model.Run{TaskID: "recorded", Region: "us-west-1", Attempt: 1, StartedAt: now, EndedAt: now, Status: model.RunSucceeded, Template: "create user name=toto"}); err != nil {
+					t.Fatal(err)
+				}
+				reverts, err = schedClient.RevertNow("recorded")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := reverts[0].Content, "delete user name=toto"; got != want {
+					t.Fatalf("got %q, want %q", got, want)
+				}
+			})
+
+			t.Run("watch events", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				events, err := schedClient.Watch(ctx, client.WatchFilter{Region: "us-west-1"})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err = schedClient.PostTask(client.Form{Region: "eu-west-1", RunIn: "2m", Template: tplText}); err != nil {
+					t.Fatal(err)
+				}
+				posted := postTemplate(t, tplText)
+
+				waited := make(chan *model.Notification)
+				go func() {
+					n, err := schedClient.WaitTask(ctx, posted.ID)
+					if err != nil {
+						t.Error(err)
+					}
+					waited <- n
+				}()
+				time.Sleep(200 * time.Millisecond)
+
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{ExtraParams: []string{"name", "user"}}, true
+				})
+				if _, err = executeTask(posted, &happyDriver{}, env); err != nil {
+					t.Fatal(err)
+				}
+
+				for _, want := range []string{model.EventCreated, model.EventStarted, model.EventCreated, model.EventSucceeded} {
+					select {
+					case n := <-events:
+						if got := n.Event; got != want {
+							t.Fatalf("got %s, want %s", got, want)
+						}
+						if got, want := n.Region, "us-west-1"; got != want {
+							t.Fatalf("got %s, want %s", got, want)
+						}
+					case <-time.After(5 * time.Second):
+						t.Fatalf("no %s event received", want)
+					}
+				}
+
+				select {
+				case n := <-waited:
+					if n == nil || n.Event != model.EventSucceeded || n.TaskID != posted.ID {
+						t.Fatalf("unexpected event %#v", n)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("task end not waited")
+				}
+
+				cancel()
+				for range events {
+				}
+			})
+
+			t.Run("metrics", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				posted := postTemplate(t, tplText)
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{ExtraParams: []string{"name", "user"}}, true
+				})
+				if _, err := executeTask(posted, &happyDriver{}, env); err != nil {
+					t.Fatal(err)
+				}
+
+				resp, err := http.Get(service.discoveryURL() + "/metrics")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				b, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, want := range []string{
+					"scheduler_pending_tasks 1\n",
+					"scheduler_failed_tasks 0\n",
+					"scheduler_running_tasks 0\n",
+					`scheduler_executions_total{status="succeeded",region="us-west-1"} `,
+					`scheduler_execution_duration_seconds_bucket{region="us-west-1",le="+Inf"} `,
+					"scheduler_schedule_lag_seconds_count ",
+				} {
+					if !strings.Contains(string(b), want) {
+						t.Fatalf("missing %q in metrics\n%s", want, b)
+					}
+				}
+			})
+
+			t.Run("audit log", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				dir, err := ioutil.TempDir("", "audit-")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+				if auditor, err = openAuditLog(filepath.Join(dir, "audit.log")); err != nil {
+					t.Fatal(err)
+				}
+				defer func() { auditor = nil }()
+
+				posted := postTemplate(t, tplText)
+				other := postTemplate(t, tplText)
+				if err = schedClient.Cancel(posted.ID); err != nil {
+					t.Fatal(err)
+				}
+
+				entries, err := schedClient.Audit(client.AuditFilter{TaskID: posted.ID})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(entries), 2; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				for i, action := range []string{model.AuditCreate, model.AuditCancel} {
+					if got, want := entries[i].Action, action; got != want {
+						t.Fatalf("got %s, want %s", got, want)
+					}
+					if got, want := entries[i].Caller, "anonymous"; got != want {
+						t.Fatalf("got %s, want %s", got, want)
+					}
+					if entries[i].RemoteAddr == "" {
+						t.Fatal("expected remote address of the caller")
+					}
+				}
+
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{ExtraParams: []string{"name", "user"}}, true
+				})
+				if _, err = executeTask(other, &happyDriver{}, env); err != nil {
+					t.Fatal(err)
+				}
+				entries, err = schedClient.Audit(client.AuditFilter{Caller: schedulerCaller})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var actions []string
+				for _, e := range entries {
+					actions = append(actions, e.Action)
+				}
+				if got, want := strings.Join(actions, ","), "start,create,end"; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				if n, err := verifyAuditLog(auditor.path); err != nil || n != 6 {
+					t.Fatalf("got %d verified entries (%v), want 6", n, err)
+				}
+			})
+
+			t.Run("execution history", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				posted := postTemplate(t, tplText)
+				before := time.Now().UTC()
+
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{ExtraParams: []string{"name", "user"}}, true
+				})
+				if _, err := executeTask(posted, &happyDriver{}, env); err != nil {
+					t.Fatal(err)
+				}
+
+				failing := postTemplate(t, "create user name=titi")
+				if _, err := executeTask(failing, &failDriver{}, env); err == nil {
+					t.Fatal("expected error, got nil")
+				}
+
+				runs, err := schedClient.ListRuns(posted.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(runs), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := runs[0].Status, model.RunSucceeded; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				if got, want := runs[0].Template, tplText; got != want {
+					t.Fatalf("got \n%q\nwant\n%q\n", got, want)
+				}
+				if runs[0].RevertTaskID == "" {
+					t.Fatal("expected revert task id")
+				}
+				if _, err = schedClient.GetTask(runs[0].RevertTaskID); err != nil {
+					t.Fatal(err)
+				}
+
+				runs, err = schedClient.ListRuns(failing.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(runs), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := runs[0].Status, model.RunFailed; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				if runs[0].Error == "" {
+					t.Fatal("expected run error")
+				}
+
+				history, err := schedClient.History(before, time.Time{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(history), 2; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := history[0].TaskID, posted.ID; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				history, err = schedClient.History(time.Time{}, before)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(history), 0; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+			})
+
+			t.Run("retry failed execution", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				if _, err := schedClient.PostTask(client.Form{Region: "us-west-1", Retry: model.RetryPolicy{Multiplier: 0.5}, Template: tplText}); err == nil {
+					t.Fatal("expected error for multiplier below 1, got nil")
+				}
+
+				posted, err := schedClient.PostTask(client.Form{
+					Region:   "us-west-1",
+					Retry:    model.RetryPolicy{MaxAttempts: 2, InitialBackoff: 10 * time.Minute},
+					Template: tplText,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := posted.Retry.MaxAttempts, 2; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := posted.Retry.InitialBackoff, 10*time.Minute; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{RequiredParams: []string{"name", "user"}}, true
+				})
+				if _, err = executeTask(posted, &failDriver{}, env); err == nil {
+					t.Fatal("expected error, got nil")
+				}
+
+				tk, err := schedClient.GetTask(posted.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := tk.Attempts, 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if delay := time.Until(tk.NextAttemptAt); delay < 7*time.Minute || delay > 13*time.Minute {
+					t.Fatalf("got next attempt in %s, want around 10m", delay)
+				}
+				if got, want := tk.NextRunAt(), tk.NextAttemptAt; !got.Equal(want) {
+					t.Fatalf("got next run at %s, want %s", got, want)
+				}
+
+				if _, err = executeTask(tk, &failDriver{}, env); err == nil {
+					t.Fatal("expected error, got nil")
+				}
+
+				tasks, err := schedClient.ListTasks()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(tasks), 0; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				fails, err := schedClient.ListFailures()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(fails), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := fails[0].Attempts, 2; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+			})
+
+			t.Run("retry and delete failures", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{RequiredParams: []string{"name", "user"}}, true
+				})
+				posted := postTemplate(t, tplText)
+				if _, err := executeTask(posted, &failDriver{}, env); err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				other := postTemplate(t, "create user name=titi")
+				if _, err := executeTask(other, &failDriver{}, env); err == nil {
+					t.Fatal("expected error, got nil")
+				}
+
+				retried, err := schedClient.RetryFailure(posted.ID, client.RescheduleForm{RunIn: "1h"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := retried.ID, posted.ID; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				if got, want := retried.Attempts, 0; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if retried.Failure != nil {
+					t.Fatalf("got failure %v, want none", retried.Failure)
+				}
+				if got, want := retried.RevertAt.Sub(retried.RunAt), posted.RevertAt.Sub(posted.RunAt); got != want {
+					t.Fatalf("got revert delay %s, want %s", got, want)
+				}
+				if delay := time.Until(retried.RunAt); delay < 59*time.Minute || delay > time.Hour {
+					t.Fatalf("got run in %s, want 1h", delay)
+				}
+
+				tasks, err := schedClient.ListTasks()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(tasks), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+
+				runs, err := schedClient.ListRuns(posted.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(runs), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := runs[0].Status, model.RunFailed; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				if err = schedClient.DeleteFailure(other.ID); err != nil {
+					t.Fatal(err)
+				}
+				fails, err := schedClient.ListFailures()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(fails), 0; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if err = schedClient.DeleteFailure(other.ID); err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				if _, err = schedClient.RetryFailure(other.ID, client.RescheduleForm{}); err == nil {
+					t.Fatal("expected error, got nil")
+				}
+			})
+
+			t.Run("misfire policy", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				if _, err := schedClient.PostTask(client.Form{Region: "us-west-1", Misfire: model.MisfirePolicy{Action: "later"}, Template: tplText}); err == nil {
+					t.Fatal("expected error for invalid misfire policy, got nil")
+				}
+
+				posted, err := schedClient.PostTask(client.Form{Region: "us-west-1", RunIn: "2m", Template: tplText})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := posted.Misfire, (model.MisfirePolicy{Action: model.MisfireWindow, Window: time.Hour}); got != want {
+					t.Fatalf("got %v, want %v", got, want)
+				}
+
+				posted, err = schedClient.PostTask(client.Form{Region: "us-west-1", RunIn: "2m", Misfire: model.MisfirePolicy{Action: model.MisfireSkip}, Template: tplText})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := posted.Misfire, (model.MisfirePolicy{Action: model.MisfireSkip}); got != want {
+					t.Fatalf("got %v, want %v", got, want)
+				}
+
+				if err = missTask(posted, "too late"); err != nil {
+					t.Fatal(err)
+				}
+				missed, err := schedClient.ListMissed()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(missed), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := missed[0].Missed.Reason, "too late"; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				recurring, err := schedClient.PostTask(client.Form{Region: "us-west-1", Cron: "@hourly", Template: tplText})
+				if err != nil {
+					t.Fatal(err)
+				}
+				recurring.RunAt = recurring.RunAt.Add(-2 * time.Hour)
+				if err = missTask(recurring, "too late"); err != nil {
+					t.Fatal(err)
+				}
+				rearmed, err := schedClient.GetTask(recurring.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !rearmed.RunAt.After(time.Now()) {
+					t.Fatalf("got run at %s, want rearmed in the future", rearmed.RunAt)
+				}
+			})
+
+			t.Run("execution timeout", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				posted, err := schedClient.PostTask(client.Form{Region: "us-west-1", RunIn: "2m", Timeout: 100 * time.Millisecond, Template: "create user name=hang"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := posted.Timeout, 100*time.Millisecond; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				drv := &hangDriver{release: make(chan struct{})}
+				defer close(drv.release)
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{RequiredParams: []string{"name"}}, true
+				})
+				if _, err = executeTask(posted, drv, env); err == nil || !strings.Contains(err.Error(), "timed out") {
+					t.Fatalf("got %v, want timeout error", err)
+				}
+
+				fails, err := schedClient.ListFailures()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(fails), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+			})
+
+			t.Run("abort running task", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				if err := schedClient.Abort("unknown", client.RescheduleForm{}); err == nil {
+					t.Fatal("expected error for unknown task, got nil")
+				}
+
+				posted := postTemplate(t, "create user name=done\ncreate user name=hang")
+				if err := schedClient.Abort(posted.ID, client.RescheduleForm{}); err == nil {
+					t.Fatal("expected error for task not running, got nil")
+				}
+
+				drv := &hangDriver{release: make(chan struct{})}
+				defer close(drv.release)
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{RequiredParams: []string{"name"}}, true
+				})
+				errc := make(chan error)
+				go func() {
+					_, err := executeTask(posted, drv, env)
+					errc <- err
+				}()
+
+				time.Sleep(100 * time.Millisecond)
+				if err := schedClient.Abort(posted.ID, client.RescheduleForm{RevertIn: "10m"}); err != nil {
+					t.Fatal(err)
+				}
+				if got, want := <-errc, errExecutionAborted; got != want {
+					t.Fatalf("got %v, want %v", got, want)
+				}
+
+				cancelled, err := schedClient.ListCancelled()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(cancelled), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+
+				runs, err := schedClient.ListRuns(posted.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(runs), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := runs[0].Status, model.RunAborted; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+
+				revert, err := schedClient.GetTask(runs[0].RevertTaskID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := revert.Content, "delete user name=done"; got != want {
+					t.Fatalf("got %q, want %q", got, want)
+				}
+				if delay := time.Until(revert.RunAt); delay < 9*time.Minute || delay > 10*time.Minute {
+					t.Fatalf("got revert in %s, want 10m", delay)
+				}
+			})
+
+			t.Run("rollback on failure", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				posted, err := schedClient.PostTask(client.Form{Region: "us-west-1", RunIn: "2m", RollbackOnFailure: true, Template: "create user name=done\ncreate user name=fail"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !posted.RollbackOnFailure {
+					t.Fatal("expected rollback on failure")
+				}
+
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{RequiredParams: []string{"name"}}, true
+				})
+				if _, err = executeTask(posted, &partialFailDriver{}, env); err == nil {
+					t.Fatal("expected error, got nil")
+				}
+
+				runs, err := schedClient.ListRuns(posted.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, want := len(runs), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+				if got, want := runs[0].Status, model.RunFailed; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				rb := runs[0].Rollback
+				if rb == nil {
+					t.Fatal("expected rollback, got nil")
+				}
+				if got, want := rb.Status, model.RunSucceeded; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				if got, want := rb.Template, "delete user name=done"; got != want {
+					t.Fatalf("got %q, want %q", got, want)
+				}
+
+				other := postTemplate(t, "create user name=done\ncreate user name=fail")
+				if _, err = executeTask(other, &partialFailDriver{}, env); err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				if runs, err = schedClient.ListRuns(other.ID); err != nil {
+					t.Fatal(err)
+				}
+				if runs[0].Rollback != nil {
+					t.Fatalf("got rollback %v, want none", runs[0].Rollback)
+				}
+			})
+
+			t.Run("fail executing driver", func(t *testing.T) {
+				defer taskStore.Cleanup()
+
+				postTemplate(t, tplText)
+
+				tasks, err := schedClient.ListTasks()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got, want := len(tasks), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+
+				task := tasks[0]
+
+				env := newTemplateEnv(func(key string) (template.Definition, bool) {
+					return template.Definition{RequiredParams: []string{"name", "user"}}, true
+				})
+				if _, err := executeTask(task, &failDriver{}, env); err == nil {
+					t.Fatal("expected error, got nil")
+				}
+
+				tasks, err = schedClient.ListTasks()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got, want := len(tasks), 0; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+
+				fails, err := schedClient.ListFailures()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if got, want := len(fails), 1; got != want {
+					t.Fatalf("got %d, want %d", got, want)
+				}
+
+				if got, want := fails[0].Content, tplText; got != want {
+					t.Fatalf("got \n%q\nwant\n%q\n", got, want)
+				}
+
+				failure := fails[0].Failure
+				if failure == nil {
+					t.Fatal("expected failure reason, got nil")
+				}
+				if got, want := failure.Stage, model.StageDryRun; got != want {
+					t.Fatalf("got %s, want %s", got, want)
+				}
+				if !strings.Contains(failure.Error, "mock driver failure") {
+					t.Fatalf("got %q, want mock driver failure", failure.Error)
+				}
+				if failure.FailedAt.IsZero() {
+					t.Fatal("expected failure time, got zero")
+				}
+			})
+		})
+	}
 }
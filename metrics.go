@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wallix/awless-scheduler/model"
+)
+
+var (
+	latencyBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+	storeBuckets   = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+	metrics = newMetricsRegistry()
+)
+
+// metricsRegistry collects the scheduler metrics, exposed in the Prometheus text format
+type metricsRegistry struct {
+	mux sync.Mutex
+
+	executions         map[[2]string]uint64
+	executionDurations map[string]*histogram
+	scheduleLag        *histogram
+	storeOperations    map[string]*histogram
+	dispatchDurations  *histogram
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		executions:         make(map[[2]string]uint64),
+		executionDurations: make(map[string]*histogram),
+		scheduleLag:        newHistogram(latencyBuckets),
+		storeOperations:    make(map[string]*histogram),
+		dispatchDurations:  newHistogram(storeBuckets),
+	}
+}
+
+func (m *metricsRegistry) observeRun(run *model.Run) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.executions[[2]string{run.Status, run.Region}]++
+	if run.Status == model.RunMissed {
+		return
+	}
+	h, ok := m.executionDurations[run.Region]
+	if !ok {
+		h = newHistogram(latencyBuckets)
+		m.executionDurations[run.Region] = h
+	}
+	h.observe(run.EndedAt.Sub(run.StartedAt))
+}
+
+func (m *metricsRegistry) observeScheduleLag(lag time.Duration) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	if lag < 0 {
+		lag = 0
+	}
+	m.scheduleLag.observe(lag)
+}
+
+func (m *metricsRegistry) observeStoreOperation(op string, start time.Time) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	h, ok := m.storeOperations[op]
+	if !ok {
+		h = newHistogram(storeBuckets)
+		m.storeOperations[op] = h
+	}
+	h.observe(time.Since(start))
+}
+
+func (m *metricsRegistry) observeDispatch(start time.Time) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.dispatchDurations.observe(time.Since(start))
+}
+
+func (m *metricsRegistry) write(w io.Writer) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	writeHelp(w, "scheduler_executions_total", "counter", "Task runs by status and region.")
+	var keys [][2]string
+	for k := range m.executions {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "scheduler_executions_total{status=%q,region=%q} %d\n", k[0], k[1], m.executions[k])
+	}
+
+	writeHelp(w, "scheduler_execution_duration_seconds", "histogram", "Duration of the task executions by region.")
+	for _, region := range sortedKeys(m.executionDurations) {
+		m.executionDurations[region].write(w, "scheduler_execution_duration_seconds", fmt.Sprintf("region=%q", region))
+	}
+
+	writeHelp(w, "scheduler_schedule_lag_seconds", "histogram", "Delay between the scheduled run time and the actual start of the executions.")
+	m.scheduleLag.write(w, "scheduler_schedule_lag_seconds", "")
+
+	writeHelp(w, "scheduler_store_operation_duration_seconds", "histogram", "Duration of the store operations.")
+	for _, op := range sortedKeys(m.storeOperations) {
+		m.storeOperations[op].write(w, "scheduler_store_operation_duration_seconds", fmt.Sprintf("operation=%q", op))
+	}
+
+	writeHelp(w, "scheduler_dispatch_duration_seconds", "histogram", "Duration of the dispatcher rounds collecting and starting the due tasks.")
+	m.dispatchDurations.write(w, "scheduler_dispatch_duration_seconds", "")
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pending, err := taskStore.GetTasks()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, fmt.Sprintf("cannot count tasks: %s", err), http.StatusInternalServerError)
+		return
+	}
+	failures, err := taskStore.GetFailures()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, fmt.Sprintf("cannot count failures: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeHelp(w, "scheduler_pending_tasks", "gauge", "Tasks waiting for their run.")
+	fmt.Fprintf(w, "scheduler_pending_tasks %d\n", len(pending))
+	writeHelp(w, "scheduler_failed_tasks", "gauge", "Tasks moved to the failures.")
+	fmt.Fprintf(w, "scheduler_failed_tasks %d\n", len(failures))
+	writeHelp(w, "scheduler_running_tasks", "gauge", "Tasks being executed.")
+	fmt.Fprintf(w, "scheduler_running_tasks %d\n", runningExecutions())
+	metrics.write(w)
+}
+
+func writeHelp(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortedKeys(m map[string]*histogram) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, labels, sep, upper, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", name, labels, h.sum, name, labels, h.count)
+}
+
+// measuredStore records the duration of the store operations
+type measuredStore struct {
+	store
+}
+
+func (s *measuredStore) Create(tk *model.Task) error {
+	defer metrics.observeStoreOperation("create", time.Now())
+	return s.store.Create(tk)
+}
+
+func (s *measuredStore) Get(id string) (*model.Task, error) {
+	defer metrics.observeStoreOperation("get", time.Now())
+	return s.store.Get(id)
+}
+
+func (s *measuredStore) Update(tk *model.Task) error {
+	defer metrics.observeStoreOperation("update", time.Now())
+	return s.store.Update(tk)
+}
+
+func (s *measuredStore) Remove(id string) error {
+	defer metrics.observeStoreOperation("remove", time.Now())
+	return s.store.Remove(id)
+}
+
+func (s *measuredStore) GetTasks() ([]*model.Task, error) {
+	defer metrics.observeStoreOperation("get_tasks", time.Now())
+	return s.store.GetTasks()
+}
+
+func (s *measuredStore) GetFailures() ([]*model.Task, error) {
+	defer metrics.observeStoreOperation("get_failures", time.Now())
+	return s.store.GetFailures()
+}
+
+func (s *measuredStore) GetCancelled() ([]*model.Task, error) {
+	defer metrics.observeStoreOperation("get_cancelled", time.Now())
+	return s.store.GetCancelled()
+}
+
+func (s *measuredStore) MarkAsFailed(id string) error {
+	defer metrics.observeStoreOperation("mark_as_failed", time.Now())
+	return s.store.MarkAsFailed(id)
+}
+
+func (s *measuredStore) GetFailure(id string) (*model.Task, error) {
+	defer metrics.observeStoreOperation("get_failure", time.Now())
+	return s.store.GetFailure(id)
+}
+
+func (s *measuredStore) RemoveFailure(id string) error {
+	defer metrics.observeStoreOperation("remove_failure", time.Now())
+	return s.store.RemoveFailure(id)
+}
+
+func (s *measuredStore) Requeue(tk *model.Task) error {
+	defer metrics.observeStoreOperation("requeue", time.Now())
+	return s.store.Requeue(tk)
+}
+
+func (s *measuredStore) MarkAsCancelled(id string) error {
+	defer metrics.observeStoreOperation("mark_as_cancelled", time.Now())
+	return s.store.MarkAsCancelled(id)
+}
+
+func (s *measuredStore) GetMissed() ([]*model.Task, error) {
+	defer metrics.observeStoreOperation("get_missed", time.Now())
+	return s.store.GetMissed()
+}
+
+func (s *measuredStore) MarkAsMissed(id string) error {
+	defer metrics.observeStoreOperation("mark_as_missed", time.Now())
+	return s.store.MarkAsMissed(id)
+}
+
+func (s *measuredStore) AddRun(run *model.Run) error {
+	defer metrics.observeStoreOperation("add_run", time.Now())
+	return s.store.AddRun(run)
+}
+
+func (s *measuredStore) GetRuns(taskID string) ([]*model.Run, error) {
+	defer metrics.observeStoreOperation("get_runs", time.Now())
+	return s.store.GetRuns(taskID)
+}
+
+func (s *measuredStore) GetHistory(from, to time.Time) ([]*model.Run, error) {
+	defer metrics.observeStoreOperation("get_history", time.Now())
+	return s.store.GetHistory(from, to)
+}
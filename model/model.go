@@ -4,59 +4,346 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"hash/adler32"
 	"time"
 )
 
+// Used by the legacy task files, whose metadata was encoded in the filename
 const (
 	AwlessFileExt = "aws"
 	StampLayout   = "2006-01-02-15h04m05s"
 )
 
+const (
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+	RunMissed    = "missed"
+	RunAborted   = "aborted"
+)
+
+// Task lifecycle events notified to webhooks
+const (
+	EventCreated   = "created"
+	EventStarted   = "started"
+	EventSucceeded = "succeeded"
+	EventFailed    = "failed"
+	EventReverted  = "reverted"
+	EventMissed    = "missed"
+)
+
+// Notification is the payload posted to webhooks
+type Notification struct {
+	Event         string
+	TaskID        string
+	ParentID      string `json:",omitempty"`
+	Kind          string `json:",omitempty"`
+	Owner         string `json:",omitempty"`
+	Region        string
+	Status        string   `json:",omitempty"`
+	Error         string   `json:",omitempty"`
+	CommandErrors []string `json:",omitempty"`
+	Template      string   `json:",omitempty"`
+	Time          time.Time
+}
+
+// Actions recorded in the audit log
+const (
+	AuditCreate        = "create"
+	AuditCancel        = "cancel"
+	AuditReschedule    = "reschedule"
+	AuditDelete        = "delete"
+	AuditAbort         = "abort"
+	AuditRetry         = "retry"
+	AuditDeleteFailure = "delete-failure"
+	AuditRevertNow     = "revert-now"
+	AuditStart         = "start"
+	AuditEnd           = "end"
+	AuditRevert        = "revert"
+	AuditIssueToken    = "issue-token"
+	AuditRevokeToken   = "revoke-token"
+)
+
+// AuditEntry is a line of the audit log, chained to the previous entry by its hash
+type AuditEntry struct {
+	Seq        int64
+	Time       time.Time
+	Action     string
+	TaskID     string `json:",omitempty"`
+	Caller     string
+	RemoteAddr string `json:",omitempty"`
+	Detail     string `json:",omitempty"`
+	PrevHash   string
+	Hash       string
+}
+
+// Kinds of task: a run task is scheduled by a client, a revert task reverts the execution of its parent
+const (
+	KindRun    = "run"
+	KindRevert = "revert"
+)
+
+// Stages of a task execution
+const (
+	StageCompile = "compile"
+	StageDryRun  = "dry-run"
+	StageRun     = "run"
+)
+
 type ServiceInfo struct {
-	Uptime          string
-	ServiceAddr     string
+	Uptime      string
+	ServiceAddr string
+	// Deprecated: tasks are dispatched when due, the scheduler no longer ticks
 	TickerFrequency string
 	UnixSockMode    bool
+	AuthRequired    bool
+}
+
+// Token authenticates API callers. Only its hash is stored, its secret
+// is returned once when issued
+type Token struct {
+	ID        string
+	Name      string
+	Admin     bool
+	Secret    string `json:",omitempty"`
+	Hash      string `json:",omitempty"`
+	CreatedAt time.Time
 }
 
 type Task struct {
+	ID       string
 	Content  string
 	RunAt    time.Time
 	RevertAt time.Time
 	Region   string
+	Cron     string
+	Timezone string
+	Kind     string
+	ParentID string
+	// identity of the caller who created the task, inherited by its reverts
+	Owner string
+
+	// IDs of the pending tasks whose parent is the task, filled in when getting a task
+	Children []string
+
+	Retry         RetryPolicy
+	Attempts      int
+	NextAttemptAt time.Time
+
+	Misfire MisfirePolicy
+	Timeout time.Duration
+
+	RollbackOnFailure bool
+
+	Failure *Failure
+	Missed  *Missed
+}
+
+// Missed is the reason a task was not executed
+type Missed struct {
+	Reason   string
+	MissedAt time.Time
+}
+
+// Failure is the reason of the last failed execution of a task
+type Failure struct {
+	Error    string
+	FailedAt time.Time
+	Stage    string
+	Commands []string
+}
+
+// Run is the execution record of a task
+type Run struct {
+	TaskID        string
+	Region        string
+	Owner         string `json:",omitempty"`
+	Attempt       int
+	StartedAt     time.Time
+	EndedAt       time.Time
+	Status        string
+	Template      string
+	Error         string
+	CommandErrors []string
+	RevertTaskID  string
+	// template reverting the commands that succeeded, if any
+	RevertTemplate string `json:",omitempty"`
+	Rollback       *Run   `json:",omitempty"`
 }
 
-func (tk *Task) AsFilename() string {
-	checksum := adler32.Checksum([]byte(tk.Content))
-	return fmt.Sprintf("%d_%s_%s_%s.%s", checksum, tk.RunAt.UTC().Format(StampLayout), tk.RevertAt.UTC().Format(StampLayout), tk.Region, AwlessFileExt)
+func (tk *Task) NextRunAt() time.Time {
+	if !tk.NextAttemptAt.IsZero() {
+		return tk.NextAttemptAt
+	}
+	return tk.RunAt
 }
 
 func (tk *Task) MarshalJSON() ([]byte, error) {
 	buffer := bytes.NewBufferString("{")
-	jsonValue, err := json.Marshal(tk.Content)
+	var err error
+	writeField := func(name string, v interface{}) {
+		if err != nil {
+			return
+		}
+		var jsonValue []byte
+		if jsonValue, err = json.Marshal(v); err == nil {
+			buffer.WriteString(fmt.Sprintf("\"%s\":%s,", name, jsonValue))
+		}
+	}
+
+	writeField("ID", tk.ID)
+	writeField("Content", tk.Content)
+	if !tk.RunAt.IsZero() {
+		writeField("RunAt", tk.RunAt.UTC())
+		writeField("RunIn", time.Until(tk.RunAt).String())
+	}
+	if !tk.RevertAt.IsZero() {
+		writeField("RevertAt", tk.RevertAt.UTC())
+		writeField("RevertIn", time.Until(tk.RevertAt).String())
+	}
+	if tk.Cron != "" {
+		writeField("Cron", tk.Cron)
+	}
+	if tk.Timezone != "" {
+		writeField("Timezone", tk.Timezone)
+	}
+	if tk.Retry.MaxAttempts > 0 {
+		writeField("Retry", tk.Retry)
+	}
+	if tk.Attempts > 0 {
+		writeField("Attempts", tk.Attempts)
+	}
+	if !tk.NextAttemptAt.IsZero() {
+		writeField("NextAttemptAt", tk.NextAttemptAt.UTC())
+	}
+	if tk.Kind != "" {
+		writeField("Kind", tk.Kind)
+	}
+	if tk.ParentID != "" {
+		writeField("ParentID", tk.ParentID)
+	}
+	if tk.Owner != "" {
+		writeField("Owner", tk.Owner)
+	}
+	if len(tk.Children) > 0 {
+		writeField("Children", tk.Children)
+	}
+	if tk.Misfire.Action != "" {
+		writeField("Misfire", tk.Misfire)
+	}
+	if tk.Timeout > 0 {
+		writeField("Timeout", tk.Timeout.String())
+	}
+	if tk.RollbackOnFailure {
+		writeField("RollbackOnFailure", tk.RollbackOnFailure)
+	}
+	if tk.Failure != nil {
+		writeField("Failure", tk.Failure)
+	}
+	if tk.Missed != nil {
+		writeField("Missed", tk.Missed)
+	}
+	writeField("Region", tk.Region)
 	if err != nil {
 		return nil, err
 	}
-	buffer.WriteString(fmt.Sprintf("\"Content\":%s,", jsonValue))
-	if !tk.RunAt.IsZero() {
-		jsonValue, err = json.Marshal(tk.RunAt)
+
+	buffer.Truncate(buffer.Len() - 1)
+	buffer.WriteString("}")
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalJSON reads the task timeout as a duration string, as marshalled
+func (tk *Task) UnmarshalJSON(b []byte) error {
+	type taskFields Task
+	v := struct {
+		*taskFields
+		Timeout string
+	}{taskFields: (*taskFields)(tk)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	tk.Timeout = 0
+	if v.Timeout != "" {
+		timeout, err := time.ParseDuration(v.Timeout)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		buffer.WriteString(fmt.Sprintf("\"RunAt\":%s,", jsonValue))
-		buffer.WriteString(fmt.Sprintf("\"RunIn\":\"%s\",", time.Until(tk.RunAt)))
+		tk.Timeout = timeout
 	}
-	if !tk.RevertAt.IsZero() {
-		jsonValue, err = json.Marshal(tk.RevertAt)
+	return nil
+}
+
+// RetryPolicy delays the next attempt of a failed execution by InitialBackoff,
+// multiplied by Multiplier after each failed attempt and randomly varied by
+// the Jitter fraction. A task fails for good after MaxAttempts attempts.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	Multiplier     float64
+	Jitter         float64
+}
+
+type jsonRetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff string
+	Multiplier     float64
+	Jitter         float64
+}
+
+func (p RetryPolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonRetryPolicy{MaxAttempts: p.MaxAttempts, InitialBackoff: p.InitialBackoff.String(), Multiplier: p.Multiplier, Jitter: p.Jitter})
+}
+
+func (p *RetryPolicy) UnmarshalJSON(b []byte) error {
+	var v jsonRetryPolicy
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	backoff, err := time.ParseDuration(v.InitialBackoff)
+	if err != nil {
+		return err
+	}
+	*p = RetryPolicy{MaxAttempts: v.MaxAttempts, InitialBackoff: backoff, Multiplier: v.Multiplier, Jitter: v.Jitter}
+	return nil
+}
+
+const (
+	MisfireRun    = "run"
+	MisfireSkip   = "skip"
+	MisfireWindow = "window"
+)
+
+// MisfirePolicy tells what to do with a task dispatched late: run it anyway,
+// skip it, or run it only if it is late by less than Window
+type MisfirePolicy struct {
+	Action string
+	Window time.Duration
+}
+
+type jsonMisfirePolicy struct {
+	Action string
+	Window string `json:",omitempty"`
+}
+
+func (p MisfirePolicy) MarshalJSON() ([]byte, error) {
+	v := jsonMisfirePolicy{Action: p.Action}
+	if p.Action == MisfireWindow {
+		v.Window = p.Window.String()
+	}
+	return json.Marshal(v)
+}
+
+func (p *MisfirePolicy) UnmarshalJSON(b []byte) error {
+	var v jsonMisfirePolicy
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*p = MisfirePolicy{Action: v.Action}
+	if v.Window != "" {
+		window, err := time.ParseDuration(v.Window)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		buffer.WriteString(fmt.Sprintf("\"RevertAt\":%s,", jsonValue))
-		buffer.WriteString(fmt.Sprintf("\"RevertIn\":\"%s\",", time.Until(tk.RevertAt)))
+		p.Window = window
 	}
-	buffer.WriteString(fmt.Sprintf("\"Region\":\"%s\"", tk.Region))
-
-	buffer.WriteString("}")
-	return buffer.Bytes(), nil
+	return nil
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+var (
+	allowedMux sync.RWMutex
+	// nil when any local user may connect to the unix socket, replaced with setAllowedUIDs
+	allowedUIDs map[uint32]bool
+)
+
+func setAllowedUIDs(uids map[uint32]bool) {
+	allowedMux.Lock()
+	defer allowedMux.Unlock()
+
+	allowedUIDs = uids
+}
+
+func allowedPeers() map[uint32]bool {
+	allowedMux.RLock()
+	defer allowedMux.RUnlock()
+
+	return allowedUIDs
+}
+
+type peerCredKey struct{}
+
+// peerCred identifies the process connected to the unix socket
+type peerCred struct {
+	uid, gid uint32
+	pid      int32
+}
+
+func (c *peerCred) String() string {
+	return fmt.Sprintf("unix:uid=%d,gid=%d,pid=%d", c.uid, c.gid, c.pid)
+}
+
+// name is the user name of the peer, or its uid if unknown
+func (c *peerCred) name() string {
+	uid := strconv.FormatUint(uint64(c.uid), 10)
+	if u, err := user.LookupId(uid); err == nil {
+		return u.Username
+	}
+	return "uid:" + uid
+}
+
+// peerCredContext tags the connection context with the credentials of the unix socket peer
+func peerCredContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	cred, err := readPeerCred(uc)
+	if err != nil {
+		log.Printf("cannot read unix socket peer credentials: %s", err)
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+// identifyPeer names the caller after the user connected to the unix socket,
+// rejecting the users not in the allowed uids
+func identifyPeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed := allowedPeers()
+		cred, ok := r.Context().Value(peerCredKey{}).(*peerCred)
+		if !ok {
+			if allowed != nil {
+				http.Error(w, "unknown peer credentials", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if allowed != nil && !allowed[cred.uid] {
+			http.Error(w, fmt.Sprintf("uid %d not allowed", cred.uid), http.StatusForbidden)
+			return
+		}
+		identified := r.WithContext(context.WithValue(r.Context(), callerKey{}, cred.name()))
+		identified.RemoteAddr = cred.String()
+		next.ServeHTTP(w, identified)
+	})
+}
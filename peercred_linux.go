@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+func readPeerCred(c *net.UnixConn) (*peerCred, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	if err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return &peerCred{uid: ucred.Uid, gid: ucred.Gid, pid: ucred.Pid}, nil
+}
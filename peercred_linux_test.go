@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wallix/awless-scheduler/client"
+	"github.com/wallix/awless-scheduler/model"
+	"github.com/wallix/awless/template/driver"
+)
+
+func TestUnixSockPeerCredentials(t *testing.T) {
+	taskStore = createTmpStore("fs")
+	defer taskStore.Destroy()
+	defer func(f func(string) (driver.Driver, error)) { driversFunc = f }(driversFunc)
+	driversFunc = func(region string) (driver.Driver, error) {
+		return &happyDriver{}, nil
+	}
+
+	dir, err := ioutil.TempDir("", "sock-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(addr string) { SOCK_ADDR = addr }(SOCK_ADDR)
+	SOCK_ADDR = filepath.Join(dir, "scheduler.sock")
+	if auditor, err = openAuditLog(filepath.Join(dir, "audit.log")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { auditor = nil }()
+
+	service, err := NewSchedulerService(identifyPeer(routes()), "", "127.0.0.1:9097", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	info, err := os.Stat(SOCK_ADDR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.Mode().Perm(), os.FileMode(0600); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if err = service.setSocketPermissions("0660", fmt.Sprint(os.Getgid())); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = os.Stat(SOCK_ADDR); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := info.Mode().Perm(), os.FileMode(0660); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	go service.Start()
+
+	// the unix socket already accepts connections, wait for the discovery service
+	var cli *client.Client
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if cli, err = client.New(service.discoveryURL()); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+	posted, err := cli.PostTask(client.Form{Region: "us-west-1", RunIn: "2m", Template: "create user name=toto"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &peerCred{uid: uint32(os.Getuid())}
+	if got, want := posted.Owner, peer.name(); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	entries, err := auditor.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(entries), 1; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	if got, want := entries[0].Action, model.AuditCreate; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if got, want := entries[0].RemoteAddr, fmt.Sprintf("unix:uid=%d,gid=%d,pid=%d", os.Getuid(), os.Getgid(), os.Getpid()); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	setAllowedUIDs(map[uint32]bool{uint32(os.Getuid()) + 1: true})
+	defer setAllowedUIDs(nil)
+	if _, err = cli.ListTasks(); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("got %v, want 403 error", err)
+	}
+	setAllowedUIDs(map[uint32]bool{uint32(os.Getuid()) + 1: true, uint32(os.Getuid()): true})
+	if _, err = cli.ListTasks(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func readPeerCred(c *net.UnixConn) (*peerCred, error) {
+	return nil, errors.New("peer credentials unsupported on this platform")
+}
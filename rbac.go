@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// Verbs granted by the roles of the access policy
+const (
+	verbRead       = "read"
+	verbCreate     = "create"
+	verbReschedule = "reschedule"
+	verbCancel     = "cancel"
+	verbDelete     = "delete"
+	verbRetry      = "retry"
+	verbRevert     = "revert"
+	verbAudit      = "audit"
+	anyVerb        = "*"
+)
+
+var allVerbs = []string{verbRead, verbCreate, verbReschedule, verbCancel, verbDelete, verbRetry, verbRevert, verbAudit, anyVerb}
+
+// nil when access control is disabled
+var accessPolicy *policy
+
+// policy binds caller identities ('*' for any caller) to roles granting permissions
+type policy struct {
+	Roles    map[string][]permission
+	Bindings map[string][]string
+}
+
+// permission grants verbs on the tasks of the regions (all when empty),
+// restricted to the tasks owned by the caller with Own
+type permission struct {
+	Verbs   []string
+	Regions []string `json:",omitempty"`
+	Own     bool     `json:",omitempty"`
+}
+
+func loadPolicy(path string) (*policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &policy{}
+	if err = json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("cannot read policy file %s: %s", path, err)
+	}
+
+	for role, perms := range p.Roles {
+		for _, perm := range perms {
+			for _, verb := range perm.Verbs {
+				if !contains(allVerbs, verb) {
+					return nil, fmt.Errorf("invalid policy file %s: unknown verb '%s' in role '%s'", path, verb, role)
+				}
+			}
+		}
+	}
+	for identity, roles := range p.Bindings {
+		for _, role := range roles {
+			if _, ok := p.Roles[role]; !ok {
+				return nil, fmt.Errorf("invalid policy file %s: unknown role '%s' bound to '%s'", path, role, identity)
+			}
+		}
+	}
+	return p, nil
+}
+
+// authorize returns the reason why the caller cannot apply the verb to a task
+// of the region and owner, nil when allowed. Global verbs such as audit take
+// an empty region and owner, only granted by unrestricted permissions.
+func (p *policy) authorize(caller, verb, region, owner string) error {
+	if p == nil {
+		return nil
+	}
+
+	roles := append(append([]string{}, p.Bindings[caller]...), p.Bindings["*"]...)
+	if len(roles) == 0 {
+		return fmt.Errorf("no role granted to %s", caller)
+	}
+	for _, role := range roles {
+		for _, perm := range p.Roles[role] {
+			if perm.allows(caller, verb, region, owner) {
+				return nil
+			}
+		}
+	}
+
+	if region == "" {
+		return fmt.Errorf("%s is not allowed to %s", caller, verb)
+	}
+	if owner != caller {
+		return fmt.Errorf("%s is not allowed to %s tasks of %s in region %s", caller, verb, ownerName(owner), region)
+	}
+	return fmt.Errorf("%s is not allowed to %s tasks in region %s", caller, verb, region)
+}
+
+func (perm permission) allows(caller, verb, region, owner string) bool {
+	if !contains(perm.Verbs, verb) && !contains(perm.Verbs, anyVerb) {
+		return false
+	}
+	if len(perm.Regions) > 0 && !contains(perm.Regions, region) {
+		return false
+	}
+	if perm.Own && (owner == "" || owner != caller) {
+		return false
+	}
+	return true
+}
+
+func ownerName(owner string) string {
+	if owner == "" {
+		return "unknown owner"
+	}
+	return owner
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// authorized answers 403 with the reason when the caller of the request cannot
+// apply the verb to a task of the region and owner
+func authorized(w http.ResponseWriter, r *http.Request, verb, region, owner string) bool {
+	if err := accessPolicy.authorize(requestCaller(r), verb, region, owner); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func readable(r *http.Request, region, owner string) bool {
+	return accessPolicy.authorize(requestCaller(r), verbRead, region, owner) == nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wallix/awless-scheduler/client"
+	"github.com/wallix/awless-scheduler/model"
+)
+
+const testPolicy = `{
+  "Roles": {
+    "viewer": [{"Verbs": ["read"]}],
+    "ci": [{"Verbs": ["create", "read"], "Regions": ["us-west-1"], "Own": true}],
+    "engineer": [{"Verbs": ["read"]}, {"Verbs": ["create", "cancel", "reschedule", "revert"], "Own": true}],
+    "admin": [{"Verbs": ["*"]}]
+  },
+  "Bindings": {"alice": ["engineer"], "pipeline": ["ci"], "ops": ["admin"], "bob": ["viewer"]}
+}`
+
+func TestPolicyAuthorize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.json")
+	if err = ioutil.WriteFile(path, []byte(testPolicy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := loadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcases := []struct {
+		caller, verb, region, owner string
+		allowed                     bool
+	}{
+		{"bob", verbRead, "eu-west-1", "alice", true},
+		{"bob", verbCreate, "eu-west-1", "bob", false},
+		{"pipeline", verbCreate, "us-west-1", "pipeline", true},
+		{"pipeline", verbCreate, "eu-west-1", "pipeline", false},
+		{"pipeline", verbRead, "us-west-1", "alice", false},
+		{"alice", verbCancel, "eu-west-1", "alice", true},
+		{"alice", verbCancel, "eu-west-1", "bob", false},
+		{"alice", verbAudit, "", "", false},
+		{"ops", verbCancel, "eu-west-1", "bob", true},
+		{"ops", verbAudit, "", "", true},
+		{"unknown", verbRead, "eu-west-1", "alice", false},
+	}
+	for _, tcase := range tcases {
+		if err := p.authorize(tcase.caller, tcase.verb, tcase.region, tcase.owner); (err == nil) != tcase.allowed {
+			t.Fatalf("%s %s in %s owned by %s: got %v, want allowed %t", tcase.caller, tcase.verb, tcase.region, tcase.owner, err, tcase.allowed)
+		}
+	}
+
+	if err = (*policy)(nil).authorize("anyone", verbDelete, "eu-west-1", "alice"); err != nil {
+		t.Fatalf("got %v, want nil without policy", err)
+	}
+
+	if err = ioutil.WriteFile(path, []byte(`{"Bindings": {"alice": ["unknown"]}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadPolicy(path); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	taskStore = createTmpStore("fs")
+	defer taskStore.Destroy()
+
+	dir, err := ioutil.TempDir("", "policy-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "policy.json"), []byte(testPolicy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if accessPolicy, err = loadPolicy(filepath.Join(dir, "policy.json")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { accessPolicy = nil }()
+	if tokens, err = openTokenStore(filepath.Join(dir, "tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tokens = nil }()
+
+	srv := httptest.NewServer(requireToken(routes()))
+	defer srv.Close()
+	discovery := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(model.ServiceInfo{ServiceAddr: srv.URL, AuthRequired: true})
+	}))
+	defer discovery.Close()
+
+	clients := make(map[string]*client.Client)
+	for _, name := range []string{"alice", "pipeline", "bob"} {
+		tk, err := tokens.issue(name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clients[name], err = client.New(discovery.URL); err != nil {
+			t.Fatal(err)
+		}
+		clients[name].SetToken(tk.Secret)
+	}
+
+	for _, tk := range []*model.Task{
+		{Content: "create user name=toto", RunAt: time.Now().Add(time.Hour), Region: "us-west-1", Owner: "alice"},
+		{Content: "create user name=tata", RunAt: time.Now().Add(time.Hour), Region: "eu-west-1", Owner: "pipeline"},
+	} {
+		if err = taskStore.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tasks, err := clients["pipeline"].ListTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(tasks), 0; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	tasks, err = clients["bob"].ListTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(tasks), 2; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+
+	var alices, pipelines string
+	for _, tk := range tasks {
+		if tk.Owner == "alice" {
+			alices = tk.ID
+		} else {
+			pipelines = tk.ID
+		}
+	}
+
+	err = clients["alice"].Cancel(pipelines)
+	if err == nil || !strings.Contains(err.Error(), "403") || !strings.Contains(err.Error(), "alice is not allowed to cancel tasks of pipeline in region eu-west-1") {
+		t.Fatalf("got %v, want 403 error with reason", err)
+	}
+	if err = clients["alice"].Cancel(alices); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = clients["pipeline"].PostTask(client.Form{Region: "eu-west-1", RunIn: "2m", Template: "create user name=toto"})
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("got %v, want 403 error", err)
+	}
+	if _, err = clients["bob"].Audit(client.AuditFilter{}); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("got %v, want 403 error", err)
+	}
+
+	// a chain of reverts is left untouched when one of them is not allowed
+	parent := &model.Task{Content: "create user name=toto", RunAt: time.Now().Add(time.Hour), Region: "us-west-1", Owner: "alice", Cron: "@daily", Timezone: "UTC"}
+	if err = taskStore.Create(parent); err != nil {
+		t.Fatal(err)
+	}
+	reverts := []*model.Task{
+		{Content: "delete user name=toto", RunAt: time.Now().Add(2 * time.Hour), Region: "us-west-1", Owner: "alice", Kind: model.KindRevert, ParentID: parent.ID},
+		{Content: "delete user name=toto", RunAt: time.Now().Add(2 * time.Hour), Region: "us-west-1", Owner: "pipeline", Kind: model.KindRevert, ParentID: parent.ID},
+	}
+	for _, tk := range reverts {
+		if err = taskStore.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = clients["alice"].RevertNow(parent.ID); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("got %v, want 403 error", err)
+	}
+	if err = clients["alice"].CancelWithReverts(parent.ID); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("got %v, want 403 error", err)
+	}
+	for _, tk := range append(reverts, parent) {
+		stored, err := taskStore.Get(tk.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := stored.RunAt, tk.RunAt; !got.Equal(want) {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnix creates the unix socket accessible to its owner only, until
+// its permissions are set with setSocketPermissions
+func listenUnix(addr *net.UnixAddr) (*net.UnixListener, error) {
+	umask := syscall.Umask(0177)
+	defer syscall.Umask(umask)
+
+	return net.ListenUnix("unix", addr)
+}
@@ -0,0 +1,7 @@
+package main
+
+import "net"
+
+func listenUnix(addr *net.UnixAddr) (*net.UnixListener, error) {
+	return net.ListenUnix("unix", addr)
+}
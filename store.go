@@ -1,59 +1,134 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/wallix/awless-scheduler/model"
 )
 
+var errTaskNotFound = errors.New("task not found")
+
+const taskFileExt = "json"
+
 type store interface {
 	Create(tk *model.Task) error
+	Get(id string) (*model.Task, error)
+	Update(tk *model.Task) error
 	Remove(id string) error
 	GetTasks() ([]*model.Task, error)
 	GetFailures() ([]*model.Task, error)
+	GetCancelled() ([]*model.Task, error)
 	MarkAsFailed(id string) error
+	GetFailure(id string) (*model.Task, error)
+	RemoveFailure(id string) error
+	Requeue(tk *model.Task) error
+	MarkAsCancelled(id string) error
+	GetMissed() ([]*model.Task, error)
+	MarkAsMissed(id string) error
+	AddRun(run *model.Run) error
+	GetRuns(taskID string) ([]*model.Run, error)
+	GetHistory(from, to time.Time) ([]*model.Run, error)
 	Cleanup() error
+	Close() error
 	Destroy() error
 }
 
+func newStore(backend, root string) (store, error) {
+	switch backend {
+	case "fs":
+		return NewFSStore(root)
+	case "bolt":
+		return NewBoltStore(root)
+	default:
+		return nil, fmt.Errorf("unknown store backend '%s'", backend)
+	}
+}
+
 type fsStore struct {
 	mux sync.Mutex
 
-	root, tasksDir, failuresDir string
+	root, tasksDir, failuresDir, cancelledDir, missedDir, historyDir string
 }
 
 func NewFSStore(root string) (store, error) {
 	tasksDir := filepath.Join(root, "tasks")
 	failuresDir := filepath.Join(root, "failures")
+	cancelledDir := filepath.Join(root, "cancelled")
+	missedDir := filepath.Join(root, "missed")
+	historyDir := filepath.Join(root, "history")
 
-	if err := os.MkdirAll(tasksDir, 0755); err != nil {
-		return nil, fmt.Errorf("cannot make new store: %s", err)
+	for _, dir := range []string{tasksDir, failuresDir, cancelledDir, missedDir, historyDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("cannot make new store: %s", err)
+		}
 	}
 
-	if err := os.MkdirAll(failuresDir, 0755); err != nil {
+	if err := migrateLegacyFiles(tasksDir, failuresDir, cancelledDir); err != nil {
 		return nil, fmt.Errorf("cannot make new store: %s", err)
 	}
 
-	return &fsStore{root: root, tasksDir: tasksDir, failuresDir: failuresDir}, nil
+	return &fsStore{root: root, tasksDir: tasksDir, failuresDir: failuresDir, cancelledDir: cancelledDir, missedDir: missedDir, historyDir: historyDir}, nil
 }
 
 func (fs *fsStore) Create(tk *model.Task) error {
 	fs.mux.Lock()
 	defer fs.mux.Unlock()
 
-	err := ioutil.WriteFile(filepath.Join(fs.tasksDir, tk.AsFilename()), []byte(tk.Content), 0644)
+	if tk.ID == "" {
+		id, err := newTaskID()
+		if err != nil {
+			return err
+		}
+		tk.ID = id
+	}
+	if _, err := findTaskFile(fs.tasksDir, tk.ID); err == nil {
+		return fmt.Errorf("cannot create task: task %s already exists", tk.ID)
+	} else if err != errTaskNotFound {
+		return err
+	}
+	err := writeTaskFile(filepath.Join(fs.tasksDir, taskFilename(tk.ID)), tk)
 	if err != nil {
 		return fmt.Errorf("cannot create task as file: %s", err)
 	}
 	return nil
 }
 
+func (fs *fsStore) Get(id string) (*model.Task, error) {
+	fs.mux.Lock()
+	file, err := findTaskFile(fs.tasksDir, id)
+	fs.mux.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return New(file)
+}
+
+func (fs *fsStore) Update(tk *model.Task) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	file, err := findTaskFile(fs.tasksDir, tk.ID)
+	if err != nil {
+		return err
+	}
+
+	if err = writeTaskFile(file, tk); err != nil {
+		return fmt.Errorf("cannot update task file: %s", err)
+	}
+	return nil
+}
+
 func (fs *fsStore) GetTasks() ([]*model.Task, error) {
 	tasks := make([]*model.Task, 0)
 
@@ -82,22 +157,160 @@ func (fs *fsStore) GetFailures() ([]*model.Task, error) {
 	return tasks, nil
 }
 
+func (fs *fsStore) GetCancelled() ([]*model.Task, error) {
+	tasks := make([]*model.Task, 0)
+
+	for _, file := range fs.getCancelled() {
+		tk, err := New(file)
+		if err != nil {
+			return tasks, err
+		}
+		tasks = append(tasks, tk)
+	}
+
+	return tasks, nil
+}
+
 func (fs *fsStore) Remove(id string) error {
 	fs.mux.Lock()
 	defer fs.mux.Unlock()
 
-	return os.Remove(filepath.Join(fs.tasksDir, id))
+	file, err := findTaskFile(fs.tasksDir, id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(file)
 }
 
 func (fs *fsStore) MarkAsFailed(id string) error {
-	return os.Rename(filepath.Join(fs.tasksDir, id), filepath.Join(fs.failuresDir, id))
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	file, err := findTaskFile(fs.tasksDir, id)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file, filepath.Join(fs.failuresDir, filepath.Base(file)))
+}
+
+func (fs *fsStore) GetFailure(id string) (*model.Task, error) {
+	fs.mux.Lock()
+	file, err := findTaskFile(fs.failuresDir, id)
+	fs.mux.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return New(file)
+}
+
+func (fs *fsStore) RemoveFailure(id string) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	file, err := findTaskFile(fs.failuresDir, id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+// Requeue moves a failed task back to the pending tasks with its updated fields
+func (fs *fsStore) Requeue(tk *model.Task) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	file, err := findTaskFile(fs.failuresDir, tk.ID)
+	if err != nil {
+		return err
+	}
+	if err = writeTaskFile(filepath.Join(fs.tasksDir, taskFilename(tk.ID)), tk); err != nil {
+		return fmt.Errorf("cannot requeue task: %s", err)
+	}
+	return os.Remove(file)
+}
+
+func (fs *fsStore) MarkAsCancelled(id string) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	file, err := findTaskFile(fs.tasksDir, id)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file, filepath.Join(fs.cancelledDir, filepath.Base(file)))
+}
+
+func (fs *fsStore) GetMissed() ([]*model.Task, error) {
+	tasks := make([]*model.Task, 0)
+
+	for _, file := range fs.getMissed() {
+		tk, err := New(file)
+		if err != nil {
+			return tasks, err
+		}
+		tasks = append(tasks, tk)
+	}
+
+	return tasks, nil
+}
+
+func (fs *fsStore) MarkAsMissed(id string) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	file, err := findTaskFile(fs.tasksDir, id)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file, filepath.Join(fs.missedDir, filepath.Base(file)))
+}
+
+// AddRun stores runs as history/<task id>/<start time>.json
+func (fs *fsStore) AddRun(run *model.Run) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	if run.TaskID == "" || strings.ContainsAny(run.TaskID, `\/`) {
+		return fmt.Errorf("cannot add run: invalid task id '%s'", run.TaskID)
+	}
+	dir := filepath.Join(fs.historyDir, run.TaskID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot add run: %s", err)
+	}
+
+	b, err := json.MarshalIndent(run, "", " ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(filepath.Join(dir, fmt.Sprintf("%020d.%s", run.StartedAt.UnixNano(), taskFileExt)), b)
+}
+
+func (fs *fsStore) GetRuns(taskID string) ([]*model.Run, error) {
+	if taskID == "" || strings.ContainsAny(taskID, `\/`) {
+		return make([]*model.Run, 0), nil
+	}
+
+	fs.mux.Lock()
+	files := glob(filepath.Join(fs.historyDir, taskID))
+	fs.mux.Unlock()
+
+	return readRuns(files, time.Time{}, time.Time{})
+}
+
+func (fs *fsStore) GetHistory(from, to time.Time) ([]*model.Run, error) {
+	fs.mux.Lock()
+	files := glob(filepath.Join(fs.historyDir, "*"))
+	fs.mux.Unlock()
+
+	return readRuns(files, from, to)
 }
 
 func (fs *fsStore) Cleanup() error {
 	fs.mux.Lock()
 	defer fs.mux.Unlock()
 
-	files, _ := filepath.Glob(filepath.Join(fs.root, "*", fmt.Sprintf("*.%s", model.AwlessFileExt)))
+	files, _ := filepath.Glob(filepath.Join(fs.root, "*", fmt.Sprintf("*.%s", taskFileExt)))
 	for _, file := range files {
 		err := os.Remove(file)
 		if err != nil {
@@ -105,6 +318,17 @@ func (fs *fsStore) Cleanup() error {
 		}
 	}
 
+	dirs, _ := filepath.Glob(filepath.Join(fs.historyDir, "*"))
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *fsStore) Close() error {
 	return nil
 }
 
@@ -129,8 +353,66 @@ func (fs *fsStore) getFailures() []string {
 	return glob(fs.failuresDir)
 }
 
+func (fs *fsStore) getCancelled() []string {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	return glob(fs.cancelledDir)
+}
+
+func (fs *fsStore) getMissed() []string {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	return glob(fs.missedDir)
+}
+
+func findTaskFile(dir, id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `\/`) {
+		return "", errTaskNotFound
+	}
+
+	file := filepath.Join(dir, taskFilename(id))
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return "", errTaskNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+func readRuns(files []string, from, to time.Time) ([]*model.Run, error) {
+	runs := make([]*model.Run, 0)
+
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return runs, err
+		}
+		run := &model.Run{}
+		if err = json.Unmarshal(b, run); err != nil {
+			return runs, fmt.Errorf("cannot read run %s: %s", file, err)
+		}
+		if inTimeRange(run.StartedAt, from, to) {
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].StartedAt.Before(runs[j].StartedAt) })
+
+	return runs, nil
+}
+
+// inTimeRange checks t is in [from, to), a zero bound being unlimited
+func inTimeRange(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
+
+func taskFilename(id string) string {
+	return fmt.Sprintf("%s.%s", id, taskFileExt)
+}
+
 func glob(root string) []string {
-	files, err := filepath.Glob(filepath.Join(root, fmt.Sprintf("*.%s", model.AwlessFileExt)))
+	files, err := filepath.Glob(filepath.Join(root, fmt.Sprintf("*.%s", taskFileExt)))
 	if err != nil {
 		log.Println(err)
 	}
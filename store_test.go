@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"hash/adler32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wallix/awless-scheduler/model"
+)
+
+func TestFSStoreMigratesLegacyFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "scheduler-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	runAt := time.Date(2017, 7, 12, 10, 0, 0, 0, time.UTC)
+	writeLegacy := func(dir, prefix, opts, content string) {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("%s%d_%s_%s_", prefix, adler32.Checksum([]byte(content)), runAt.Format(model.StampLayout), time.Time{}.Format(model.StampLayout))
+		if opts != "" {
+			name += opts + "_"
+		}
+		name += "us-west-1." + model.AwlessFileExt
+		if err := ioutil.WriteFile(filepath.Join(root, dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeLegacy("tasks", "", "", "create instance name=first")
+	writeLegacy("failures", "0123456789abcdef_", "cron=%40daily&tz=Europe%2FParis", "create instance name=second")
+
+	s, err := NewFSStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tasks, err := s.GetTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(tasks), 1; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	if tasks[0].ID == "" {
+		t.Fatal("expected migrated task to get an id")
+	}
+	if got, want := tasks[0].Content, "create instance name=first"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if got, want := tasks[0].RunAt, runAt; !got.Equal(want) {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if !tasks[0].RevertAt.IsZero() {
+		t.Fatalf("got %s, want zero revert time", tasks[0].RevertAt)
+	}
+
+	fails, err := s.GetFailures()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(fails), 1; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	if got, want := fails[0].ID, "0123456789abcdef"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if got, want := fails[0].Cron, "@daily"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if got, want := fails[0].Timezone, "Europe/Paris"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	legacy, _ := filepath.Glob(filepath.Join(root, "*", "*."+model.AwlessFileExt))
+	if got, want := len(legacy), 0; got != want {
+		t.Fatalf("got %d legacy files left, want %d", got, want)
+	}
+}
+
+func TestBoltStoreImportsFSStore(t *testing.T) {
+	root, err := ioutil.TempDir("", "scheduler-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	fs, err := NewFSStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := &model.Task{Content: "create instance name=pending", RunAt: time.Now().Add(time.Hour).UTC()}
+	failed := &model.Task{Content: "create instance name=failed", RunAt: time.Now().UTC()}
+	for _, tk := range []*model.Task{pending, failed} {
+		if err = fs.Create(tk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = fs.MarkAsFailed(failed.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.AddRun(&model.Run{TaskID: failed.ID, StartedAt: time.Now().UTC()}); err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+
+	s, err := NewBoltStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tk, err := s.Get(pending.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tk.Content, pending.Content; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if _, err = s.GetFailure(failed.ID); err != nil {
+		t.Fatal(err)
+	}
+	runs, err := s.GetRuns(failed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(runs), 1; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+
+	if err = s.Remove(pending.ID); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = NewBoltStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err = s.Get(pending.ID); err == nil {
+		t.Fatal("expected fs tasks to be imported only on first open")
+	}
+}
+
+func TestLegacyFilenameFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "legacy-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := "create instance name=first"
+	runAt := time.Date(2017, 7, 12, 10, 0, 0, 0, time.UTC)
+	prefix := fmt.Sprintf("%d_%s_%s", adler32.Checksum([]byte(content)), runAt.Format(model.StampLayout), time.Time{}.Format(model.StampLayout))
+
+	tcases := []struct {
+		name, id, region, cron string
+	}{
+		{prefix + "_us-west-1", "", "us-west-1", ""},
+		{prefix + "_my_region", "", "my_region", ""},
+		{"0123456789abcdef_" + prefix + "_my_region", "0123456789abcdef", "my_region", ""},
+		{"0123456789abcdef_" + prefix + "__my_region", "0123456789abcdef", "my_region", ""},
+		{"0123456789abcdef_" + prefix + "_cron=%40daily_my_region", "0123456789abcdef", "my_region", "@daily"},
+	}
+	for _, tcase := range tcases {
+		path := filepath.Join(dir, tcase.name+"."+model.AwlessFileExt)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		tk, err := newFromLegacyFile(path)
+		if err != nil {
+			t.Fatalf("%s: %s", tcase.name, err)
+		}
+		if tcase.id != "" && tk.ID != tcase.id || tk.ID == "" {
+			t.Fatalf("%s: got id %q, want %q", tcase.name, tk.ID, tcase.id)
+		}
+		if got, want := tk.Region, tcase.region; got != want {
+			t.Fatalf("%s: got %s, want %s", tcase.name, got, want)
+		}
+		if got, want := tk.Cron, tcase.cron; got != want {
+			t.Fatalf("%s: got %s, want %s", tcase.name, got, want)
+		}
+		if got, want := tk.RunAt, runAt; !got.Equal(want) {
+			t.Fatalf("%s: got %s, want %s", tcase.name, got, want)
+		}
+	}
+}
+
+func TestStoreKeepsAllTaskFields(t *testing.T) {
+	for _, backend := range storeBackends {
+		t.Run(backend, func(t *testing.T) {
+			s := createTmpStore(backend)
+			defer s.Destroy()
+
+			testStoreKeepsAllTaskFields(t, s)
+		})
+	}
+}
+
+func testStoreKeepsAllTaskFields(t *testing.T, s store) {
+	tk := &model.Task{
+		Content:  "create instance name=toto",
+		RunAt:    time.Now().UTC(),
+		RevertAt: time.Now().UTC().Add(time.Hour),
+		Region:   "my_region",
+		Cron:     "*/5 * * * *",
+		Timezone: "America/New_York",
+		Misfire:  model.MisfirePolicy{Action: model.MisfireWindow, Window: 10 * time.Minute},
+	}
+	if err := s.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Get(tk.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != tk.ID || got.Content != tk.Content || got.Region != tk.Region || got.Cron != tk.Cron || got.Timezone != tk.Timezone {
+		t.Fatalf("got %#v, want %#v", got, tk)
+	}
+	if !got.RunAt.Equal(tk.RunAt) || !got.RevertAt.Equal(tk.RevertAt) {
+		t.Fatalf("got %#v, want %#v", got, tk)
+	}
+	if got.Misfire != tk.Misfire {
+		t.Fatalf("got %#v, want %#v", got.Misfire, tk.Misfire)
+	}
+
+	if _, err = s.Get("../" + tk.ID); err != errTaskNotFound {
+		t.Fatalf("got %v, want %v", err, errTaskNotFound)
+	}
+
+	duplicate := &model.Task{ID: tk.ID, Content: "delete instance id=toto", RunAt: time.Now().UTC(), Region: "my_region"}
+	if err = s.Create(duplicate); err == nil {
+		t.Fatal("expected error creating an existing task, got nil")
+	}
+	if got, err = s.Get(tk.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got.Content != tk.Content {
+		t.Fatalf("got %s, want %s", got.Content, tk.Content)
+	}
+}
+
+func TestBoltStoreListsTasksByRunTime(t *testing.T) {
+	s := createTmpStore("bolt")
+	defer s.Destroy()
+
+	now := time.Now().UTC()
+	for _, delay := range []time.Duration{time.Hour, -time.Hour, time.Minute} {
+		if err := s.Create(&model.Task{Content: "create instance name=toto", RunAt: now.Add(delay), Region: "us-west-1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tasks, err := s.GetTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(tasks), 3; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	tasks[1].RunAt = tasks[1].RunAt.Add(time.Hour)
+	if err = s.Update(tasks[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	tasks, err = s.GetTasks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []time.Time{now.Add(-time.Hour), now.Add(time.Hour), now.Add(time.Hour + time.Minute)} {
+		if got := tasks[i].RunAt; !got.Equal(want) {
+			t.Fatalf("%d: got %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestStoreHistory(t *testing.T) {
+	for _, backend := range storeBackends {
+		t.Run(backend, func(t *testing.T) {
+			s := createTmpStore(backend)
+			defer s.Destroy()
+
+			start := time.Date(2017, 7, 12, 10, 0, 0, 0, time.UTC)
+			for i, taskID := range []string{"first", "second", "first"} {
+				run := &model.Run{TaskID: taskID, StartedAt: start.Add(time.Duration(i) * time.Hour), Status: model.RunSucceeded}
+				if err := s.AddRun(run); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			runs, err := s.GetRuns("first")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(runs), 2; got != want {
+				t.Fatalf("got %d, want %d", got, want)
+			}
+			if got, want := runs[1].StartedAt, start.Add(2*time.Hour); !got.Equal(want) {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+
+			runs, err = s.GetRuns("unknown")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(runs), 0; got != want {
+				t.Fatalf("got %d, want %d", got, want)
+			}
+
+			runs, err = s.GetHistory(start.Add(30*time.Minute), start.Add(2*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(runs), 1; got != want {
+				t.Fatalf("got %d, want %d", got, want)
+			}
+			if got, want := runs[0].TaskID, "second"; got != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+
+			runs, err = s.GetHistory(time.Time{}, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(runs), 3; got != want {
+				t.Fatalf("got %d, want %d", got, want)
+			}
+		})
+	}
+}
@@ -1,63 +1,301 @@
 package main
 
 import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"hash/adler32"
 	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
+	"github.com/robfig/cron"
 	"github.com/wallix/awless-scheduler/model"
 	"github.com/wallix/awless/template"
 	"github.com/wallix/awless/template/driver"
 )
 
-func New(filePath string) (tk *model.Task, err error) {
-	tk = &model.Task{}
+// taskDocumentVersion is bumped whenever the stored task document changes in an incompatible way
+const taskDocumentVersion = 1
 
-	var content []byte
-	content, err = ioutil.ReadFile(filePath)
+// taskFields has the fields of model.Task without its API JSON marshalling
+type taskFields model.Task
+
+type taskDocument struct {
+	Version int
+	taskFields
+}
+
+func New(filePath string) (*model.Task, error) {
+	content, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		return
+		return nil, err
 	}
-	tk.Content = string(content)
-	fileName := filepath.Base(filePath)
-	name := strings.TrimSuffix(fileName, filepath.Ext(fileName))
-	splits := strings.SplitN(name, "_", 4)
-	checksum, err := strconv.ParseUint(splits[0], 10, 32)
+
+	tk, err := unmarshalTaskDocument(content)
 	if err != nil {
-		return
+		return nil, fmt.Errorf("cannot read task document %s: %s", filePath, err)
 	}
-	if cs := adler32.Checksum([]byte(tk.Content)); uint32(checksum) != cs {
-		err = fmt.Errorf("unexpected checksum for file %s. Exepcted %d", name, cs)
-		return
+	return tk, nil
+}
+
+func marshalTaskDocument(tk *model.Task) ([]byte, error) {
+	fields := taskFields(*tk)
+	fields.Children = nil
+	return json.MarshalIndent(taskDocument{Version: taskDocumentVersion, taskFields: fields}, "", " ")
+}
+
+func unmarshalTaskDocument(b []byte) (*model.Task, error) {
+	var doc taskDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Version < 1 || doc.Version > taskDocumentVersion {
+		return nil, fmt.Errorf("unsupported task document version %d", doc.Version)
 	}
-	tk.RunAt, err = time.Parse(model.StampLayout, splits[1])
+
+	tk := model.Task(doc.taskFields)
+	return &tk, nil
+}
+
+func writeTaskFile(filePath string, tk *model.Task) error {
+	b, err := marshalTaskDocument(tk)
 	if err != nil {
-		return
+		return err
 	}
-	tk.RevertAt, err = time.Parse(model.StampLayout, splits[2])
+	return writeFileAtomically(filePath, b)
+}
+
+// writeFileAtomically replaces the file content so that a crash never leaves it truncated
+func writeFileAtomically(filePath string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filePath), ".tmp-")
 	if err != nil {
-		return
+		return err
+	}
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
 	}
-	tk.Region = splits[3]
 
-	return
+	return os.Rename(tmp.Name(), filePath)
+}
+
+func newTaskID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := cryptorand.Read(b); err != nil {
+		return "", fmt.Errorf("cannot generate task id: %s", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// nextCronRun evaluates the expression on the wall clock of 'loc' so runs keep their local hour across DST changes
+func nextCronRun(expr string, loc *time.Location, after time.Time) (time.Time, error) {
+	schedule, err := cron.ParseStandard(expr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return schedule.Next(after.In(loc)).UTC(), nil
+}
+
+// rearmTask moves a recurring task to its next occurrence, keeping the delay before revert
+func rearmTask(tk *model.Task) error {
+	if err := nextOccurrence(tk); err != nil {
+		return err
+	}
+	tk.Failure = nil
+
+	return taskStore.Update(tk)
+}
+
+func nextOccurrence(tk *model.Task) error {
+	after := time.Now().UTC()
+	if tk.RunAt.After(after) {
+		after = tk.RunAt
+	}
+	loc, err := time.LoadLocation(tk.Timezone)
+	if err != nil {
+		return err
+	}
+	next, err := nextCronRun(tk.Cron, loc, after)
+	if err != nil {
+		return err
+	}
+	if !tk.RevertAt.IsZero() {
+		tk.RevertAt = next.Add(tk.RevertAt.Sub(tk.RunAt))
+	}
+	tk.RunAt = next
+	tk.Attempts, tk.NextAttemptAt = 0, time.Time{}
+	return nil
+}
+
+// missTask records a missed run. A recurring task is rearmed, other tasks are moved to the missed ones
+func missTask(tk *model.Task, reason string) error {
+	now := time.Now().UTC()
+	run := &model.Run{TaskID: tk.ID, Region: tk.Region, Owner: tk.Owner, Attempt: tk.Attempts, StartedAt: now, EndedAt: now, Status: model.RunMissed, Error: reason}
+	if err := taskStore.AddRun(run); err != nil {
+		log.Printf("cannot record missed run of task %s: %s", tk.ID, err)
+	}
+	metrics.observeRun(run)
+	auditRun(tk, run)
+	notifyTask(model.EventMissed, tk, run)
+
+	if tk.Cron != "" {
+		return rearmTask(tk)
+	}
+
+	tk.Missed = &model.Missed{Reason: reason, MissedAt: now}
+	if err := taskStore.Update(tk); err != nil {
+		return err
+	}
+	return taskStore.MarkAsMissed(tk.ID)
+}
+
+// misfireReason tells why a late task must not run according to its misfire
+// policy (the server default if unset), or returns an empty string
+func misfireReason(tk *model.Task, now time.Time) string {
+	policy := tk.Misfire
+	if policy.Action == "" {
+		policy = defaultMisfirePolicy()
+	}
+
+	late := now.Sub(tk.NextRunAt())
+	switch policy.Action {
+	case model.MisfireSkip:
+		if late > misfireThreshold {
+			return fmt.Sprintf("run at %s was skipped, %s late", tk.NextRunAt().Format(time.RFC3339), late)
+		}
+	case model.MisfireWindow:
+		if late > policy.Window {
+			return fmt.Sprintf("run at %s is %s late, beyond the %s window", tk.NextRunAt().Format(time.RFC3339), late, policy.Window)
+		}
+	}
+	return ""
+}
+
+// failTask schedules the next attempt of a failed task, or marks it as failed once its attempts are exhausted.
+// A recurring task is then rearmed instead, keeping its failure until its next run
+func failTask(tk *model.Task) error {
+	if tk.Attempts < tk.Retry.MaxAttempts {
+		tk.NextAttemptAt = time.Now().UTC().Add(nextRetryDelay(tk.Retry, tk.Attempts))
+		log.Printf("task %s failed on attempt %d/%d, next attempt at %s", tk.ID, tk.Attempts, tk.Retry.MaxAttempts, tk.NextAttemptAt)
+		return taskStore.Update(tk)
+	}
+
+	if tk.Cron != "" {
+		if err := nextOccurrence(tk); err != nil {
+			return err
+		}
+		log.Printf("recurring task %s failed, rearmed at %s", tk.ID, tk.RunAt)
+		return taskStore.Update(tk)
+	}
+
+	if err := taskStore.Update(tk); err != nil {
+		return err
+	}
+	return taskStore.MarkAsFailed(tk.ID)
+}
+
+// failUnstartedTask records a failed attempt of a task that could not be
+// executed, so that its retry policy applies
+func failUnstartedTask(tk *model.Task, err error) error {
+	tk.Attempts++
+	now := time.Now().UTC()
+	run := &model.Run{TaskID: tk.ID, Region: tk.Region, Owner: tk.Owner, Attempt: tk.Attempts, StartedAt: now, EndedAt: now, Status: model.RunFailed, Error: err.Error()}
+	if runErr := taskStore.AddRun(run); runErr != nil {
+		log.Printf("cannot record run of task %s: %s", tk.ID, runErr)
+	}
+	metrics.observeRun(run)
+	auditRun(tk, run)
+	notifyTask(model.EventFailed, tk, run)
+
+	tk.Failure = &model.Failure{Error: err.Error(), FailedAt: now, Stage: model.StageCompile}
+	return failTask(tk)
+}
+
+func nextRetryDelay(policy model.RetryPolicy, attempt int) time.Duration {
+	backoff := float64(policy.InitialBackoff) * math.Pow(policy.Multiplier, float64(attempt-1))
+	backoff += backoff * policy.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(backoff)
 }
 
 func executeTask(tk *model.Task, d driver.Driver, env *template.Env) (executed *template.Template, err error) {
+	metrics.observeScheduleLag(time.Since(tk.NextRunAt()))
+	tk.Attempts++
+	run := &model.Run{TaskID: tk.ID, Region: tk.Region, Owner: tk.Owner, Attempt: tk.Attempts, StartedAt: time.Now().UTC()}
+	stage := model.StageCompile
+
+	timeout := tk.Timeout
+	if timeout <= 0 {
+		timeout = *taskTimeout
+	}
+	exec := startExecution(tk.ID, timeout)
+	defer exec.end()
+	notifyTask(model.EventStarted, tk, nil)
+	audit(nil, model.AuditStart, tk.ID, fmt.Sprintf("region=%s attempt=%d", tk.Region, tk.Attempts))
+
 	defer func() {
-		id := tk.AsFilename()
+		if exec.isAborted() {
+			err = errExecutionAborted
+		}
+
+		run.EndedAt = time.Now().UTC()
+		run.Status = model.RunSucceeded
+		if err != nil {
+			run.Status, run.Error = model.RunFailed, err.Error()
+		}
+		if err == errExecutionAborted {
+			run.Status = model.RunAborted
+		}
+		if executed != nil {
+			run.Template = executed.String()
+			run.CommandErrors = commandErrors(executed)
+		}
+		if runErr := taskStore.AddRun(run); runErr != nil {
+			log.Printf("cannot record run of task %s: %s", tk.ID, runErr)
+		}
+		metrics.observeRun(run)
+		auditRun(tk, run)
 		if err != nil {
-			taskStore.MarkAsFailed(id)
+			notifyTask(model.EventFailed, tk, run)
+		} else if tk.Kind == model.KindRevert {
+			notifyTask(model.EventReverted, tk, run)
 		} else {
-			err = taskStore.Remove(id)
+			notifyTask(model.EventSucceeded, tk, run)
+		}
+
+		if err == errExecutionAborted {
+			if abortErr := endAbortedTask(tk); abortErr != nil {
+				log.Printf("cannot mark task %s as aborted: %s", tk.ID, abortErr)
+			}
+		} else if err != nil {
+			tk.Failure = &model.Failure{Error: err.Error(), FailedAt: run.EndedAt, Stage: stage}
+			if executed != nil {
+				tk.Failure.Commands = failedCommands(executed)
+			}
+			if failErr := failTask(tk); failErr != nil {
+				log.Printf("cannot mark task %s as failed: %s", tk.ID, failErr)
+			}
+		} else if tk.Cron != "" {
+			err = rearmTask(tk)
+		} else {
+			err = taskStore.Remove(tk.ID)
 		}
 	}()
 
-	var tpl, compiled, revertTmp *template.Template
+	var tpl, compiled *template.Template
 
 	if tpl, err = template.Parse(tk.Content); err != nil {
 		return
@@ -67,34 +305,191 @@ func executeTask(tk *model.Task, d driver.Driver, env *template.Env) (executed *
 		return
 	}
 
-	env.Driver = d
+	env.Driver = &contextDriver{Driver: d, ctx: exec.ctx}
 
+	stage = model.StageDryRun
 	if err = compiled.DryRun(env); err != nil {
 		return
 	}
 
-	if executed, err = compiled.Run(env); err != nil {
+	stage = model.StageRun
+	executed, err = compiled.Run(env)
+
+	if exec.isAborted() {
+		// the commands that succeeded before the abort are reverted if asked
+		if executed != nil && template.IsRevertible(executed) {
+			revertTpl, revertErr := executed.Revert()
+			if revertErr != nil {
+				log.Printf("cannot revert aborted task %s: %s", tk.ID, revertErr)
+				return
+			}
+			run.RevertTemplate = revertTpl.String()
+			if revertAt := exec.abortRevertAt(); !revertAt.IsZero() {
+				if run.RevertTaskID, err = createRevertTask(tk, run.RevertTemplate, revertAt); err != nil {
+					log.Printf("cannot create revert of aborted task %s: %s", tk.ID, err)
+				}
+			}
+		}
+		return
+	}
+	if exec.ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("execution timed out after %s", timeout)
+	} else if err == nil && executed.HasErrors() {
+		err = errors.New(strings.Join(commandErrors(executed), ", "))
+	}
+	if err != nil {
+		if tk.RollbackOnFailure && executed != nil && template.IsRevertible(executed) {
+			run.Rollback = rollback(tk, executed, d, env, timeout)
+		}
 		return
 	}
 
-	if executed.HasErrors() {
-		var execErrors []string
-		for _, cmd := range executed.CommandNodesIterator() {
-			if cmd.CmdErr != nil {
-				execErrors = append(execErrors, cmd.CmdErr.Error())
+	// the revert is recorded to allow reverting on demand even without revert time
+	if template.IsRevertible(executed) {
+		revertTpl, revertErr := executed.Revert()
+		if revertErr == nil {
+			run.RevertTemplate = revertTpl.String()
+		}
+		if !tk.RevertAt.IsZero() {
+			if err = revertErr; err != nil {
+				return
 			}
+			run.RevertTaskID, err = createRevertTask(tk, run.RevertTemplate, tk.RevertAt)
 		}
-		err = fmt.Errorf(strings.Join(execErrors, ", "))
-		return
+	}
+	return
+}
+
+// pendingChildren returns the pending tasks whose parent is the given task
+func pendingChildren(parentID string) ([]*model.Task, error) {
+	tasks, err := taskStore.GetTasks()
+	if err != nil {
+		return nil, err
 	}
 
-	if !tk.RevertAt.IsZero() && template.IsRevertible(executed) {
-		if revertTmp, err = executed.Revert(); err != nil {
-			return
+	var children []*model.Task
+	for _, tk := range tasks {
+		if tk.ParentID == parentID {
+			children = append(children, tk)
 		}
-		revertTask := &model.Task{RunAt: tk.RevertAt, Region: tk.Region, Content: revertTmp.String()}
-		if err = taskStore.Create(revertTask); err != nil {
-			return
+	}
+	return children, nil
+}
+
+// runRevertTemplate returns the template reverting the commands of a run. Runs
+// recorded without revert template are reverted from their executed template,
+// all of its commands having succeeded
+func runRevertTemplate(run *model.Run) string {
+	if run.RevertTemplate != "" || run.Status != model.RunSucceeded || run.Template == "" {
+		return run.RevertTemplate
+	}
+	executed, err := template.Parse(run.Template)
+	if err != nil || !template.IsRevertible(executed) {
+		return ""
+	}
+	revertTpl, err := executed.Revert()
+	if err != nil {
+		log.Printf("cannot revert run of task %s: %s", run.TaskID, err)
+		return ""
+	}
+	return revertTpl.String()
+}
+
+// rollback immediately reverts the commands of a failed execution that succeeded
+func rollback(tk *model.Task, executed *template.Template, d driver.Driver, env *template.Env, timeout time.Duration) *model.Run {
+	rb := &model.Run{TaskID: tk.ID, Region: tk.Region, Owner: tk.Owner, Attempt: tk.Attempts, StartedAt: time.Now().UTC()}
+
+	var rolledBack *template.Template
+	err := func() error {
+		revertTpl, err := executed.Revert()
+		if err != nil {
+			return err
+		}
+		tpl, err := template.Parse(revertTpl.String())
+		if err != nil {
+			return err
+		}
+		compiled, _, err := template.Compile(tpl, env)
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		env.Driver = &contextDriver{Driver: d, ctx: ctx}
+
+		if rolledBack, err = compiled.Run(env); err != nil {
+			return err
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("rollback timed out after %s", timeout)
+		}
+		if rolledBack.HasErrors() {
+			return errors.New(strings.Join(commandErrors(rolledBack), ", "))
+		}
+		return nil
+	}()
+
+	rb.EndedAt = time.Now().UTC()
+	rb.Status = model.RunSucceeded
+	if err != nil {
+		log.Printf("cannot rollback task %s: %s", tk.ID, err)
+		rb.Status, rb.Error = model.RunFailed, err.Error()
+	}
+	if rolledBack != nil {
+		rb.Template = rolledBack.String()
+		rb.CommandErrors = commandErrors(rolledBack)
+	}
+	return rb
+}
+
+func createRevertTask(tk *model.Task, content string, revertAt time.Time) (string, error) {
+	revertTask := &model.Task{RunAt: revertAt, Region: tk.Region, Content: content, Kind: model.KindRevert, ParentID: tk.ID, Owner: tk.Owner, Retry: tk.Retry, Misfire: tk.Misfire, Timeout: tk.Timeout}
+	if err := taskStore.Create(revertTask); err != nil {
+		return "", err
+	}
+	notifyTask(model.EventCreated, revertTask, nil)
+	audit(nil, model.AuditCreate, revertTask.ID, fmt.Sprintf("revert of task %s %s", tk.ID, describeSchedule(revertTask)))
+	return revertTask.ID, nil
+}
+
+// auditRun records the end of a run, as a revert for the runs of revert tasks
+func auditRun(tk *model.Task, run *model.Run) {
+	action := model.AuditEnd
+	if tk.Kind == model.KindRevert {
+		action = model.AuditRevert
+	}
+	detail := run.Status
+	if run.Error != "" {
+		detail += ": " + run.Error
+	}
+	audit(nil, action, tk.ID, detail)
+}
+
+// endAbortedTask rearms an aborted recurring task, other aborted tasks are cancelled
+func endAbortedTask(tk *model.Task) error {
+	if tk.Cron != "" {
+		return rearmTask(tk)
+	}
+	if err := taskStore.Update(tk); err != nil {
+		return err
+	}
+	return taskStore.MarkAsCancelled(tk.ID)
+}
+
+func failedCommands(executed *template.Template) (cmds []string) {
+	for _, cmd := range executed.CommandNodesIterator() {
+		if cmd.CmdErr != nil {
+			cmds = append(cmds, cmd.String())
+		}
+	}
+	return
+}
+
+func commandErrors(executed *template.Template) (errs []string) {
+	for _, cmd := range executed.CommandNodesIterator() {
+		if cmd.CmdErr != nil {
+			errs = append(errs, cmd.CmdErr.Error())
 		}
 	}
 	return
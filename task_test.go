@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wallix/awless-scheduler/model"
+)
+
+func TestNextCronRunAcrossDST(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcases := []struct {
+		after, want time.Time
+	}{
+		// CEST (UTC+2) to CET (UTC+1) on 2026-10-25
+		{after: time.Date(2026, 10, 24, 9, 0, 0, 0, time.UTC), want: time.Date(2026, 10, 25, 7, 0, 0, 0, time.UTC)},
+		{after: time.Date(2026, 10, 23, 9, 0, 0, 0, time.UTC), want: time.Date(2026, 10, 24, 6, 0, 0, 0, time.UTC)},
+		// CET (UTC+1) to CEST (UTC+2) on 2027-03-28
+		{after: time.Date(2027, 3, 27, 9, 0, 0, 0, time.UTC), want: time.Date(2027, 3, 28, 6, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tcase := range tcases {
+		got, err := nextCronRun("0 8 * * *", paris, tcase.after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(tcase.want) {
+			t.Fatalf("after %s: got %s, want %s", tcase.after, got, tcase.want)
+		}
+		if got.Location() != time.UTC {
+			t.Fatalf("got location %s, want UTC", got.Location())
+		}
+	}
+
+	if _, err := nextCronRun("0 25 * * *", paris, time.Now()); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+}
+
+func TestNextRetryDelay(t *testing.T) {
+	policy := model.RetryPolicy{MaxAttempts: 5, InitialBackoff: 10 * time.Second, Multiplier: 3}
+	for attempt, want := range []time.Duration{10 * time.Second, 30 * time.Second, 90 * time.Second} {
+		if got := nextRetryDelay(policy, attempt+1); got != want {
+			t.Fatalf("attempt %d: got %s, want %s", attempt+1, got, want)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := nextRetryDelay(policy, 2); got < 15*time.Second || got > 45*time.Second {
+			t.Fatalf("got %s, want between 15s and 45s", got)
+		}
+	}
+}
+
+func TestMisfireReason(t *testing.T) {
+	now := time.Now().UTC()
+
+	tcases := []struct {
+		policy model.MisfirePolicy
+		late   time.Duration
+		missed bool
+	}{
+		{policy: model.MisfirePolicy{Action: model.MisfireRun}, late: 48 * time.Hour, missed: false},
+		{policy: model.MisfirePolicy{Action: model.MisfireSkip}, late: 10 * time.Second, missed: false},
+		{policy: model.MisfirePolicy{Action: model.MisfireSkip}, late: 2 * time.Minute, missed: true},
+		{policy: model.MisfirePolicy{Action: model.MisfireWindow, Window: 10 * time.Minute}, late: 5 * time.Minute, missed: false},
+		{policy: model.MisfirePolicy{Action: model.MisfireWindow, Window: 10 * time.Minute}, late: 15 * time.Minute, missed: true},
+		// server default: 1h window
+		{late: 30 * time.Minute, missed: false},
+		{late: 80 * time.Minute, missed: true},
+	}
+
+	for i, tcase := range tcases {
+		tk := &model.Task{RunAt: now.Add(-tcase.late), Misfire: tcase.policy}
+		if got, want := misfireReason(tk, now) != "", tcase.missed; got != want {
+			t.Fatalf("%d: got missed %t, want %t", i+1, got, want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wallix/awless-scheduler/client"
+)
+
+func TestMutualTLS(t *testing.T) {
+	taskStore = createTmpStore("fs")
+	defer taskStore.Destroy()
+
+	dir, err := ioutil.TempDir("", "tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if tokens, err = openTokenStore(filepath.Join(dir, "tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tokens = nil }()
+
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "alice", ca, caKey)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	service, err := NewSchedulerService(requireToken(routes()), "127.0.0.1:9092", "127.0.0.1:9093", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if service.tlsConfig, err = serverTLSConfig(file("server.crt"), file("server.key"), file("ca.crt")); err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	go service.Start()
+	time.Sleep(1 * time.Second)
+
+	cfg, err := client.LoadTLSConfig(file("ca.crt"), file("alice.crt"), file("alice.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := client.NewTLS(service.discoveryURL(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cli.ServiceInfo().ServiceAddr, "https://127.0.0.1:9092"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	// the client certificate authenticates the caller without token
+	if _, err = cli.ListTasks(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cli.ListTokens(); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("got %v, want 403 error", err)
+	}
+
+	noCert, err := client.LoadTLSConfig(file("ca.crt"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.NewTLS(service.discoveryURL(), noCert); err == nil {
+		t.Fatal("expected error without client certificate, got nil")
+	}
+	if _, err = client.New(service.discoveryURL()); err == nil {
+		t.Fatal("expected error with untrusted server certificate, got nil")
+	}
+}
+
+// writeCert writes the certificate and key of 'name', self-signed when parent is nil
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tpl.IsCA, tpl.BasicConstraintsValid = true, true
+		parent, parentKey = tpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
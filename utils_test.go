@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"io/ioutil"
+	"sync"
 
 	"github.com/wallix/awless/logger"
 	"github.com/wallix/awless/template"
@@ -15,18 +16,20 @@ func newTemplateEnv(fn func(string) (template.Definition, bool)) *template.Env {
 	return env
 }
 
-func createTmpFSStore() store {
+var storeBackends = []string{"fs", "bolt"}
+
+func createTmpStore(backend string) store {
 	dir, err := ioutil.TempDir("", "scheduler-")
 	if err != nil {
 		panic(err)
 	}
 
-	fs, err := NewFSStore(dir)
+	s, err := newStore(backend, dir)
 	if err != nil {
 		panic(err)
 	}
 
-	return fs
+	return s
 }
 
 type happyDriver struct {
@@ -50,3 +53,80 @@ func (*failDriver) Lookup(...string) (driver.DriverFn, error) {
 }
 func (*failDriver) SetDryRun(bool)           {}
 func (*failDriver) SetLogger(*logger.Logger) {}
+
+// blockingDriver runs commands once released, recording the number of commands running at once
+type blockingDriver struct {
+	release chan struct{}
+
+	mux                 sync.Mutex
+	total, maxTotal     int
+	running, maxRunning map[string]int
+}
+
+type regionDriver struct {
+	*blockingDriver
+	region string
+	dryRun bool
+}
+
+func (r *regionDriver) Lookup(...string) (driver.DriverFn, error) {
+	return func(ctx driver.Context, params map[string]interface{}) (interface{}, error) {
+		if r.dryRun {
+			return params["name"], nil
+		}
+		b := r.blockingDriver
+		b.mux.Lock()
+		b.total++
+		b.running[r.region]++
+		if b.total > b.maxTotal {
+			b.maxTotal = b.total
+		}
+		if b.running[r.region] > b.maxRunning[r.region] {
+			b.maxRunning[r.region] = b.running[r.region]
+		}
+		b.mux.Unlock()
+
+		<-b.release
+
+		b.mux.Lock()
+		b.total--
+		b.running[r.region]--
+		b.mux.Unlock()
+		return params["name"], nil
+	}, nil
+}
+func (r *regionDriver) SetDryRun(dry bool)     { r.dryRun = dry }
+func (*regionDriver) SetLogger(*logger.Logger) {}
+
+// partialFailDriver fails the commands named 'fail'
+type partialFailDriver struct {
+	dryRun bool
+}
+
+func (p *partialFailDriver) Lookup(...string) (driver.DriverFn, error) {
+	return func(ctx driver.Context, params map[string]interface{}) (interface{}, error) {
+		if params["name"] == "fail" && !p.dryRun {
+			return nil, errors.New("mock command failure")
+		}
+		return params["name"], nil
+	}, nil
+}
+func (p *partialFailDriver) SetDryRun(dry bool)     { p.dryRun = dry }
+func (*partialFailDriver) SetLogger(*logger.Logger) {}
+
+// hangDriver blocks the commands named 'hang' until released
+type hangDriver struct {
+	release chan struct{}
+	dryRun  bool
+}
+
+func (h *hangDriver) Lookup(...string) (driver.DriverFn, error) {
+	return func(ctx driver.Context, params map[string]interface{}) (interface{}, error) {
+		if params["name"] == "hang" && !h.dryRun {
+			<-h.release
+		}
+		return params["name"], nil
+	}, nil
+}
+func (h *hangDriver) SetDryRun(dry bool)     { h.dryRun = dry }
+func (*hangDriver) SetLogger(*logger.Logger) {}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/wallix/awless-scheduler/model"
+)
+
+const (
+	signatureHeader = "X-Scheduler-Signature"
+	eventHeader     = "X-Scheduler-Event"
+)
+
+var (
+	webhookMaxAttempts = 5
+	webhookBackoff     = 1 * time.Second
+
+	// nil when no webhook is configured
+	notifier *webhooks
+)
+
+// webhooks posts notifications to subscribers, signed with HMAC-SHA256 when a
+// secret is set. Every delivery attempt is appended to the delivery log.
+type webhooks struct {
+	urls    []string
+	secret  []byte
+	client  *http.Client
+	logFile string
+	queue   chan *model.Notification
+
+	// guards the queue from sends once stopped, since running tasks may still notify
+	mux     sync.Mutex
+	stopped bool
+
+	logMux sync.Mutex
+}
+
+// delivery is an entry of the webhook delivery log
+type delivery struct {
+	Event      string
+	TaskID     string
+	URL        string
+	Attempt    int
+	StatusCode int    `json:",omitempty"`
+	Error      string `json:",omitempty"`
+	At         time.Time
+}
+
+func newWebhooks(urls []string, secret, logFile string) *webhooks {
+	return &webhooks{
+		urls:    urls,
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		logFile: logFile,
+		queue:   make(chan *model.Notification, 100),
+	}
+}
+
+func (wh *webhooks) start() {
+	for n := range wh.queue {
+		body, err := json.Marshal(n)
+		if err != nil {
+			log.Printf("cannot marshal notification: %s", err)
+			continue
+		}
+		for _, u := range wh.urls {
+			go wh.deliver(u, n, body)
+		}
+	}
+}
+
+func (wh *webhooks) stop() {
+	wh.mux.Lock()
+	defer wh.mux.Unlock()
+
+	if !wh.stopped {
+		wh.stopped = true
+		close(wh.queue)
+	}
+}
+
+// send queues a notification, dropped once the notifier is stopped or its queue is full
+func (wh *webhooks) send(n *model.Notification) {
+	wh.mux.Lock()
+	defer wh.mux.Unlock()
+
+	if wh.stopped {
+		log.Printf("webhooks notifier stopped, dropping %s notification of task %s", n.Event, n.TaskID)
+		return
+	}
+	select {
+	case wh.queue <- n:
+	default:
+		log.Printf("webhook queue full, dropping %s notification of task %s", n.Event, n.TaskID)
+	}
+}
+
+func (wh *webhooks) deliver(u string, n *model.Notification, body []byte) {
+	backoff := webhookBackoff
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		d := &delivery{Event: n.Event, TaskID: n.TaskID, URL: u, Attempt: attempt, At: time.Now().UTC()}
+		d.StatusCode, d.Error = wh.post(u, n.Event, body)
+		wh.logDelivery(d)
+		if d.Error == "" {
+			return
+		}
+		if attempt < webhookMaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	log.Printf("cannot deliver %s notification of task %s to %s after %d attempts", n.Event, n.TaskID, u, webhookMaxAttempts)
+}
+
+func (wh *webhooks) post(u, event string, body []byte) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(eventHeader, event)
+	if len(wh.secret) > 0 {
+		req.Header.Set(signatureHeader, "sha256="+signPayload(wh.secret, body))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Sprintf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, ""
+}
+
+func (wh *webhooks) logDelivery(d *delivery) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	wh.logMux.Lock()
+	defer wh.logMux.Unlock()
+
+	f, err := os.OpenFile(wh.logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("cannot log webhook delivery: %s", err)
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		log.Printf("cannot log webhook delivery: %s", err)
+	}
+}
+
+func signPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyTask publishes a task event to the event streams and queues it for the
+// webhooks, with the outcome of its run if any
+func notifyTask(event string, tk *model.Task, run *model.Run) {
+	n := &model.Notification{Event: event, TaskID: tk.ID, ParentID: tk.ParentID, Kind: tk.Kind, Owner: tk.Owner, Region: tk.Region, Time: time.Now().UTC()}
+	if run != nil {
+		n.Status, n.Error, n.CommandErrors, n.Template = run.Status, run.Error, run.CommandErrors, run.Template
+	}
+
+	streams.publish(n)
+	if notifier != nil {
+		notifier.send(n)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wallix/awless-scheduler/model"
+	"github.com/wallix/awless/template"
+)
+
+func TestWebhooks(t *testing.T) {
+	taskStore = createTmpStore("fs")
+	defer taskStore.Destroy()
+
+	dir, err := ioutil.TempDir("", "webhooks-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	received := make(chan *model.Notification)
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if got, want := r.Header.Get(signatureHeader), "sha256="+signPayload([]byte("secret"), body); got != want {
+			t.Errorf("got signature %s, want %s", got, want)
+		}
+		n := &model.Notification{}
+		if err := json.Unmarshal(body, n); err != nil {
+			t.Error(err)
+		}
+		if got, want := r.Header.Get(eventHeader), n.Event; got != want {
+			t.Errorf("got event header %s, want %s", got, want)
+		}
+		received <- n
+	}))
+	defer srv.Close()
+
+	webhookBackoff = 10 * time.Millisecond
+	notifier = newWebhooks([]string{srv.URL}, "secret", filepath.Join(dir, "webhooks.log"))
+	go notifier.start()
+	defer func() {
+		notifier.stop()
+		notifier = nil
+	}()
+
+	tk := &model.Task{Content: "create user name=fail", RunAt: time.Now().UTC(), Region: "us-west-1", Kind: model.KindRun}
+	if err := taskStore.Create(tk); err != nil {
+		t.Fatal(err)
+	}
+	env := newTemplateEnv(func(key string) (template.Definition, bool) {
+		return template.Definition{RequiredParams: []string{"name"}}, true
+	})
+	if _, err := executeTask(tk, &partialFailDriver{}, env); err == nil {
+		t.Fatal("expected error, got nil")
+	}
+
+	notifications := make(map[string]*model.Notification)
+	for i := 0; i < 2; i++ {
+		select {
+		case n := <-received:
+			notifications[n.Event] = n
+		case <-time.After(5 * time.Second):
+			t.Fatal("notifications not all received")
+		}
+	}
+	if n := notifications[model.EventStarted]; n == nil || n.TaskID != tk.ID {
+		t.Fatalf("unexpected started notification %#v", n)
+	}
+	if n := notifications[model.EventFailed]; n == nil || n.TaskID != tk.ID || n.Status != model.RunFailed || n.Error == "" || n.Template != "create user name=fail" {
+		t.Fatalf("unexpected failed notification %#v", n)
+	}
+
+	// deliveries are logged once the responses are received
+	var deliveries []*delivery
+	for i := 0; i < 50 && len(deliveries) < 3; i++ {
+		time.Sleep(20 * time.Millisecond)
+		deliveries = readDeliveries(t, filepath.Join(dir, "webhooks.log"))
+	}
+	if got, want := len(deliveries), 3; got != want {
+		t.Fatalf("got %d deliveries, want %d", got, want)
+	}
+	var retried bool
+	for _, d := range deliveries {
+		if d.Attempt == 2 {
+			retried = true
+		}
+		if d.Attempt == 1 && d.StatusCode == http.StatusServiceUnavailable && d.Error == "" {
+			t.Fatalf("expected failed delivery to be logged with an error")
+		}
+	}
+	if !retried {
+		t.Fatal("expected failed delivery to be retried")
+	}
+}
+
+func TestWebhooksDropNotificationsOnceStopped(t *testing.T) {
+	wh := newWebhooks([]string{"http://localhost"}, "", filepath.Join(os.TempDir(), "webhooks.log"))
+	go wh.start()
+	wh.stop()
+	wh.stop()
+
+	// a task still running when the notifier stops must not panic
+	wh.send(&model.Notification{Event: model.EventSucceeded, TaskID: "running"})
+}
+
+func readDeliveries(t *testing.T, path string) (deliveries []*delivery) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		d := &delivery{}
+		if err := json.Unmarshal(scanner.Bytes(), d); err != nil {
+			t.Fatal(err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return
+}